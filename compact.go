@@ -0,0 +1,242 @@
+package blockbucketgo
+
+import (
+	"context"
+	"slices"
+	"sort"
+)
+
+// compactStepSize bounds the bytes of blocks moved by one compaction commit,
+// so that the file lock is released regularly.
+const compactStepSize = 4 << 20
+
+// Compact moves the live blocks of the bucket towards the start of the file,
+// then truncates the free space left at its end. It returns the number of bytes
+// the file shrank by.
+//
+// Compaction runs as a series of ordinary commits, each moving a bounded amount
+// of data into free space, so other readers and writers keep using the bucket
+// in between. When ctx is done Compact stops after the current commit and
+// returns ctx.Err(); the bucket stays consistent and a later Compact continues
+// where it stopped.
+//
+// While a View is open on the file nothing is moved nor truncated.
+func (e *Bucket) Compact(ctx context.Context) (int64, error) {
+	// Blocks staged by slideStep grow the file for a while: compare the
+	// sizes before and after.
+	var before int64
+	err := e.update(ctx, nil, func(idx *index) error {
+		info, err := e.writer.Stat()
+		if err != nil {
+			return err
+		}
+		before = info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		var moved bool
+		err := e.update(ctx, nil, func(idx *index) error {
+			var err error
+			moved, err = e.compactStep(idx)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !moved {
+			break
+		}
+	}
+	// The gaps left are smaller than the blocks after them: slide those
+	// blocks down.
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		var moved bool
+		err := e.update(ctx, nil, func(idx *index) error {
+			var err error
+			moved, err = e.slideStep(idx)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !moved {
+			break
+		}
+	}
+
+	// Rewrite the list into free space twice, so that neither header slot
+	// points past the compacted data any more.
+	for i := 0; i < 2; i++ {
+		err := e.update(ctx, nil, func(idx *index) error {
+			e.updateListBlock(e.newSpaceAllocator(idx.listBlock), idx.listBlock)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var after int64
+	err = e.update(ctx, nil, func(idx *index) error {
+		if err := e.truncateTail(); err != nil {
+			return err
+		}
+		info, err := e.writer.Stat()
+		if err != nil {
+			return err
+		}
+		after = info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return max(before-after, 0), nil
+}
+
+// compactStep moves blocks, last first, into free space before them and
+// reports whether any block moved.
+func (e *Bucket) compactStep(idx *index) (bool, error) {
+	listBlock := slices.Clone(idx.listBlock)
+	order := make([]int, len(listBlock))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return listBlock[order[i]].start > listBlock[order[j]].start
+	})
+
+	space := e.newSpaceAllocator(idx.listBlock)
+	var moved uint
+	for _, i := range order {
+		if moved >= compactStepSize {
+			break
+		}
+		info := listBlock[i]
+		size := info.sizeKey + info.sizeData
+		start, ok := space.allocBefore(size, info.start)
+		if !ok {
+			continue
+		}
+		key, data, err := e.pullData(info)
+		if err != nil {
+			return false, err
+		}
+		e.writeAt(append(key, data...), start)
+		listBlock[i].start = start
+		moved += size
+	}
+	if moved == 0 {
+		return false, nil
+	}
+	e.updateListBlock(space, listBlock)
+	return true, nil
+}
+
+// slideStep moves blocks, in file order, to the positions that leave no gap
+// between them, and reports whether any block moved. A block whose position
+// overlaps its current range is staged at the end of the file first, and
+// reaches its position in a later step. Lists are written at the end of the
+// file too, so that they do not get in the way.
+func (e *Bucket) slideStep(idx *index) (bool, error) {
+	if e.viewsActive() {
+		return false, nil
+	}
+	listBlock := slices.Clone(idx.listBlock)
+	order := make([]int, len(listBlock))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return listBlock[order[i]].start < listBlock[order[j]].start
+	})
+
+	space := e.newSpaceAllocator(idx.listBlock)
+	var moved uint
+	target := cFirstSize
+	for _, i := range order {
+		if moved >= compactStepSize {
+			break
+		}
+		info := listBlock[i]
+		size := info.sizeKey + info.sizeData
+		if info.start == target {
+			target += size
+			continue
+		}
+		start := target
+		if space.take(target, size) {
+			target += size
+		} else {
+			// The blocks after this one take its position meanwhile.
+			start = space.grow(size)
+		}
+		key, data, err := e.pullData(info)
+		if err != nil {
+			return false, err
+		}
+		e.writeAt(append(key, data...), start)
+		listBlock[i].start = start
+		moved += size
+	}
+	if moved == 0 {
+		return false, nil
+	}
+	space.listSpace = nil
+	e.updateListBlock(space, listBlock)
+	return true, nil
+}
+
+// truncateTail cuts the file after the last range used by either header slot,
+// unless a View is open.
+// The log is checkpointed first, so replaying it cannot grow the file again.
+func (e *Bucket) truncateTail() error {
+	if err := e.checkpoint(); err != nil {
+		return err
+	}
+	if e.viewsActive() {
+		return nil
+	}
+	buffer, err := e.readHeaderRegion()
+	if err != nil {
+		return err
+	}
+	end := cFirstSize
+	for i, h := range decodeHeaders(buffer) {
+		listBlockData, err := e.readList(h)
+		if err == nil {
+			var listBlock []block
+			listBlock, err = decodeListBlock(listBlockData, h.flags)
+			for _, b := range listBlock {
+				end = max(end, b.start+b.sizeKey+b.sizeData)
+			}
+		}
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			// The older slot is already unreadable, nothing to preserve.
+			continue
+		}
+		end = max(end, h.listEnd())
+	}
+
+	info, err := e.writer.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= int64(end) {
+		return nil
+	}
+	return e.writer.Truncate(int64(end))
+}
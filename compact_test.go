@@ -0,0 +1,137 @@
+package blockbucketgo_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+func TestCompact(t *testing.T) {
+	path, b := newTempBucket(t)
+
+	value := bytes.Repeat([]byte("v"), 1000)
+	var items []blockbucketgo.Item
+	for i := 0; i < 200; i++ {
+		items = append(
+			items,
+			blockbucketgo.Item{Key: []byte("key-" + strconv.Itoa(i)), Data: value},
+		)
+	}
+	if n := b.SetMany(items); n != len(items) {
+		t.Fatalf("SetMany: got %d want %d", n, len(items))
+	}
+	// Keep every tenth item.
+	for i := 0; i < len(items); i++ {
+		if i%10 == 0 {
+			continue
+		}
+		if _, err := b.Delete(items[i].Key); err != nil {
+			t.Fatalf("Delete error: %v", err)
+		}
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := b.Compact(context.Background())
+	if err != nil {
+		t.Fatalf("Compact error: %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != before.Size()-after.Size() || after.Size() > before.Size()/4 {
+		t.Fatalf("Compact: reclaimed %d, size %d -> %d", reclaimed, before.Size(), after.Size())
+	}
+
+	check := func(b *blockbucketgo.Bucket) {
+		t.Helper()
+		list, err := b.ListE(255)
+		if err != nil || len(list) != 20 {
+			t.Fatalf("ListE after Compact: got (%d items, %v) want 20", len(list), err)
+		}
+		for i, it := range list {
+			if string(it.Key) != string(items[i*10].Key) || !bytes.Equal(it.Data, value) {
+				t.Fatalf("item %d after Compact: got key %q", i, it.Key)
+			}
+		}
+	}
+	check(b)
+	if reclaimed, err = b.Compact(context.Background()); err != nil || reclaimed != 0 {
+		t.Fatalf("second Compact: got (%d, %v) want (0, nil)", reclaimed, err)
+	}
+
+	b2, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer b2.Close()
+	check(b2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = b2.Compact(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Compact with cancelled context: got %v", err)
+	}
+}
+
+func TestCompactSmallGaps(t *testing.T) {
+	path, b := newTempBucket(t)
+
+	var items []blockbucketgo.Item
+	for i := 0; i < 10; i++ {
+		items = append(
+			items,
+			blockbucketgo.Item{
+				Key:  []byte("small-" + strconv.Itoa(i)),
+				Data: bytes.Repeat([]byte("s"), 50),
+			},
+		)
+	}
+	items = append(
+		items,
+		blockbucketgo.Item{Key: []byte("big"), Data: bytes.Repeat([]byte("b"), 100_000)},
+	)
+	for _, item := range items {
+		b.Set(item)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := b.Delete(items[i].Key); err != nil {
+			t.Fatalf("Delete error: %v", err)
+		}
+	}
+
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No gap is large enough for the big block: it has to slide down.
+	reclaimed, err := b.Compact(context.Background())
+	if err != nil {
+		t.Fatalf("Compact error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := int64(128 + 3 + 100_000 + 64); info.Size() > max ||
+		reclaimed != before.Size()-info.Size() {
+		t.Fatalf(
+			"Compact: reclaimed %d, size %d -> %d, want at most %d",
+			reclaimed,
+			before.Size(),
+			info.Size(),
+			max,
+		)
+	}
+	if v, err := b.GetE([]byte("big")); err != nil || !bytes.Equal(v, items[10].Data) {
+		t.Fatalf("GetE after Compact: got (%d bytes, %v)", len(v), err)
+	}
+}
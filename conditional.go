@@ -0,0 +1,234 @@
+package blockbucketgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// SetIfAbsent writes item only if its key is not stored yet, and reports
+// whether it did. The check and the write happen under the file lock, so
+// concurrent callers, in any process, cannot both insert the key.
+func (e *Bucket) SetIfAbsent(item Item, opts ...WriteOption) (bool, error) {
+	return e.SetIfAbsentCtx(context.Background(), item, opts...)
+}
+
+// SetIfAbsentCtx is like SetIfAbsent but gives up waiting for the file lock
+// when ctx is done, returning ErrLockTimeout.
+func (e *Bucket) SetIfAbsentCtx(
+	ctx context.Context,
+	item Item,
+	opts ...WriteOption,
+) (applied bool, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		pos, err := e.findKey(idx, item.Key)
+		if err != nil || pos >= 0 {
+			return err
+		}
+		applied = true
+		_, err = e.setOneData(idx, item)
+		return err
+	})
+	return applied && err == nil, err
+}
+
+// CompareAndSwap replaces the value of key with newData only if its stored
+// value equals oldData, and reports whether it did. A missing key never
+// matches. Like Modify, it keeps the place and the metadata of the item.
+func (e *Bucket) CompareAndSwap(
+	key []byte,
+	oldData []byte,
+	newData []byte,
+	opts ...WriteOption,
+) (bool, error) {
+	return e.CompareAndSwapCtx(context.Background(), key, oldData, newData, opts...)
+}
+
+// CompareAndSwapCtx is like CompareAndSwap but gives up waiting for the file
+// lock when ctx is done, returning ErrLockTimeout.
+func (e *Bucket) CompareAndSwapCtx(
+	ctx context.Context,
+	key []byte,
+	oldData []byte,
+	newData []byte,
+	opts ...WriteOption,
+) (applied bool, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		pos, err := e.dataPosition(idx, key, oldData)
+		if err != nil || pos < 0 {
+			return err
+		}
+		applied = true
+		_, err = e.replaceData(idx, pos, newData)
+		return err
+	})
+	return applied && err == nil, err
+}
+
+// DeleteIf deletes key only if its stored value equals expected, and reports
+// whether it did.
+func (e *Bucket) DeleteIf(key []byte, expected []byte, opts ...WriteOption) (bool, error) {
+	return e.DeleteIfCtx(context.Background(), key, expected, opts...)
+}
+
+// DeleteIfCtx is like DeleteIf but gives up waiting for the file lock when ctx
+// is done, returning ErrLockTimeout.
+func (e *Bucket) DeleteIfCtx(
+	ctx context.Context,
+	key []byte,
+	expected []byte,
+	opts ...WriteOption,
+) (applied bool, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		pos, err := e.dataPosition(idx, key, expected)
+		if err != nil || pos < 0 {
+			return err
+		}
+		applied = true
+		_, err = e.deleteOneData(idx, key)
+		return err
+	})
+	return applied && err == nil, err
+}
+
+// dataPosition returns the position of key in idx if it is stored with the
+// value data, or -1.
+func (e *Bucket) dataPosition(idx *index, key []byte, data []byte) (int, error) {
+	pos, err := e.findKey(idx, key)
+	if err != nil || pos < 0 {
+		return -1, err
+	}
+	_, stored, err := e.pullData(idx.listBlock[pos])
+	if err != nil {
+		return -1, err
+	}
+	if !bytes.Equal(stored, data) {
+		return -1, nil
+	}
+	return pos, nil
+}
+
+// SetIfVersion writes item only if the stored version of its key is version,
+// and returns the new version. It fails with ErrConflict when the key was
+// written since it was read with that version. Version 0 stands for a missing
+// key, so SetIfVersion(item, 0) only inserts.
+//
+// Versions are stored by format 2 files only; on older files SetIfVersion
+// fails with ErrNeedsMigration.
+func (e *Bucket) SetIfVersion(item Item, version uint64, opts ...WriteOption) (uint64, error) {
+	return e.SetIfVersionCtx(context.Background(), item, version, opts...)
+}
+
+// SetIfVersionCtx is like SetIfVersion but gives up waiting for the file lock
+// when ctx is done, returning ErrLockTimeout.
+func (e *Bucket) SetIfVersionCtx(
+	ctx context.Context,
+	item Item,
+	version uint64,
+	opts ...WriteOption,
+) (newVersion uint64, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		if !storesMetadata(idx.head) {
+			return ErrNeedsMigration
+		}
+		pos, err := e.findKey(idx, item.Key)
+		if err != nil {
+			return err
+		}
+		var stored uint64
+		if pos >= 0 {
+			stored = idx.listBlock[pos].version
+		}
+		if stored != version {
+			return ErrConflict
+		}
+		newVersion = nextVersion(idx.head)
+		_, err = e.setOneData(idx, item)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+// Modify replaces the value of key with the result of fn, called with the
+// stored value (nil for a missing key). The read and the write happen under
+// one file lock, so no other writer, in any process, commits in between. If
+// fn returns an error nothing is written and Modify returns it. As for Update,
+// fn must not call any method of the Bucket.
+//
+// Only the value and the version change: the item keeps its place in the list,
+// its Priority, its SetDelayed schedule, and its lease and delivery count, so
+// that a leased item can still be acked.
+func (e *Bucket) Modify(
+	key []byte,
+	fn func(old []byte) ([]byte, error),
+	opts ...WriteOption,
+) error {
+	return e.ModifyCtx(context.Background(), key, fn, opts...)
+}
+
+// ModifyCtx is like Modify but gives up waiting for the file lock when ctx is
+// done, returning ErrLockTimeout.
+func (e *Bucket) ModifyCtx(
+	ctx context.Context,
+	key []byte,
+	fn func(old []byte) ([]byte, error),
+	opts ...WriteOption,
+) error {
+	return e.update(ctx, opts, func(idx *index) error {
+		pos, err := e.findKey(idx, key)
+		if err != nil {
+			return err
+		}
+		var old []byte
+		if pos >= 0 {
+			if _, old, err = e.pullData(idx.listBlock[pos]); err != nil {
+				return err
+			}
+		}
+		data, err := fn(old)
+		if err != nil {
+			return err
+		}
+		if pos < 0 {
+			_, err = e.setOneData(idx, Item{Key: key, Data: data})
+		} else {
+			_, err = e.replaceData(idx, pos, data)
+		}
+		return err
+	})
+}
+
+// Increment adds delta to the counter stored at key and returns the new value.
+// Counters are stored as decimal strings, and a missing key counts as 0.
+func (e *Bucket) Increment(key []byte, delta int64, opts ...WriteOption) (int64, error) {
+	return e.IncrementCtx(context.Background(), key, delta, opts...)
+}
+
+// IncrementCtx is like Increment but gives up waiting for the file lock when
+// ctx is done, returning ErrLockTimeout.
+func (e *Bucket) IncrementCtx(
+	ctx context.Context,
+	key []byte,
+	delta int64,
+	opts ...WriteOption,
+) (value int64, err error) {
+	err = e.ModifyCtx(ctx, key, func(old []byte) ([]byte, error) {
+		var n int64
+		if len(old) > 0 {
+			var err error
+			if n, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+				return nil, fmt.Errorf("blockbucketgo: value of %q is not a counter: %w", key, err)
+			}
+		}
+		value = n + delta
+		return strconv.AppendInt(nil, value, 10), nil
+	}, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
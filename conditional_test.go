@@ -0,0 +1,195 @@
+package blockbucketgo_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	_, b := newTempBucket(t)
+	key := []byte("owner")
+
+	if ok, err := b.SetIfAbsent(blockbucketgo.Item{Key: key, Data: []byte("w1")}); err != nil ||
+		!ok {
+		t.Fatalf("SetIfAbsent on missing key: got (%v, %v) want (true, nil)", ok, err)
+	}
+	if ok, err := b.SetIfAbsent(blockbucketgo.Item{Key: key, Data: []byte("w2")}); err != nil ||
+		ok {
+		t.Fatalf("SetIfAbsent on existing key: got (%v, %v) want (false, nil)", ok, err)
+	}
+
+	if ok, err := b.CompareAndSwap(key, []byte("w2"), []byte("w3")); err != nil || ok {
+		t.Fatalf("CompareAndSwap with wrong old value: got (%v, %v) want (false, nil)", ok, err)
+	}
+	if ok, err := b.CompareAndSwap(key, []byte("w1"), []byte("w3")); err != nil || !ok {
+		t.Fatalf("CompareAndSwap: got (%v, %v) want (true, nil)", ok, err)
+	}
+	if ok, err := b.CompareAndSwap([]byte("missing"), nil, []byte("x")); err != nil || ok {
+		t.Fatalf("CompareAndSwap on missing key: got (%v, %v) want (false, nil)", ok, err)
+	}
+
+	if ok, err := b.DeleteIf(key, []byte("w1")); err != nil || ok {
+		t.Fatalf("DeleteIf with wrong value: got (%v, %v) want (false, nil)", ok, err)
+	}
+	if v, err := b.GetE(key); err != nil || string(v) != "w3" {
+		t.Fatalf("GetE: got (%q, %v) want w3", v, err)
+	}
+	if ok, err := b.DeleteIf(key, []byte("w3")); err != nil || !ok {
+		t.Fatalf("DeleteIf: got (%v, %v) want (true, nil)", ok, err)
+	}
+	if _, v := b.Get(key); v != nil {
+		t.Fatalf("Get after DeleteIf: got %q", v)
+	}
+}
+
+func TestSetIfAbsentRace(t *testing.T) {
+	_, b := newTempBucket(t)
+
+	var wins atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Go(func() {
+			ok, err := b.SetIfAbsent(
+				blockbucketgo.Item{Key: []byte("leader"), Data: []byte{byte(i)}},
+			)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				wins.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	if wins.Load() != 1 {
+		t.Fatalf("SetIfAbsent applied %d times, want 1", wins.Load())
+	}
+}
+
+func TestSetIfVersion(t *testing.T) {
+	path, b := newTempBucket(t)
+	key := []byte("counter")
+
+	v1, err := b.SetIfVersion(blockbucketgo.Item{Key: key, Data: []byte("1")}, 0)
+	if err != nil || v1 == 0 {
+		t.Fatalf("SetIfVersion insert: got (%d, %v)", v1, err)
+	}
+	_, err = b.SetIfVersion(blockbucketgo.Item{Key: key, Data: []byte("x")}, 0)
+	if !errors.Is(err, blockbucketgo.ErrConflict) {
+		t.Fatalf("SetIfVersion insert of existing key: got %v, want ErrConflict", err)
+	}
+
+	item, err := b.GetItem(key)
+	if err != nil || item.Version != v1 {
+		t.Fatalf("GetItem: got (%+v, %v), want version %d", item, err, v1)
+	}
+	// Another writer updates the key between the read and the write.
+	if _, err = b.Set(blockbucketgo.Item{Key: key, Data: []byte("2")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	_, err = b.SetIfVersion(blockbucketgo.Item{Key: key, Data: []byte("lost")}, item.Version)
+	if !errors.Is(err, blockbucketgo.ErrConflict) {
+		t.Fatalf("SetIfVersion after concurrent Set: got %v, want ErrConflict", err)
+	}
+
+	items, err := b.ListE(1)
+	if err != nil || len(items) != 1 || items[0].Version <= v1 {
+		t.Fatalf("ListE: got (%+v, %v), want a version above %d", items, err, v1)
+	}
+	v3, err := b.SetIfVersion(blockbucketgo.Item{Key: key, Data: []byte("3")}, items[0].Version)
+	if err != nil || v3 <= items[0].Version {
+		t.Fatalf("SetIfVersion: got (%d, %v)", v3, err)
+	}
+
+	// Versions survive reopening and compaction.
+	b2, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	if _, err = b2.Compact(context.Background()); err != nil {
+		t.Fatalf("Compact error: %v", err)
+	}
+	if item, err = b2.GetItem(key); err != nil || item.Version != v3 || string(item.Data) != "3" {
+		t.Fatalf("GetItem after reopen: got (%+v, %v), want version %d", item, err, v3)
+	}
+
+	oldPath := filepath.Join(t.TempDir(), "v1.db")
+	old, err := blockbucketgo.Open(oldPath, blockbucketgo.FormatVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	// Migrated items get a version, so version 0 still only inserts.
+	old.Set(blockbucketgo.Item{Key: key, Data: []byte("old")})
+	if err = blockbucketgo.Migrate(oldPath); err != nil {
+		t.Fatalf("Migrate error: %v", err)
+	}
+	if item, err = old.GetItem(key); err != nil || item.Version == 0 {
+		t.Fatalf("GetItem after Migrate: got (%+v, %v), want a version", item, err)
+	}
+	_, err = old.SetIfVersion(blockbucketgo.Item{Key: key, Data: []byte("new")}, 0)
+	if !errors.Is(err, blockbucketgo.ErrConflict) {
+		t.Fatalf("SetIfVersion insert after Migrate: got %v, want ErrConflict", err)
+	}
+	if v, err := old.GetE(key); err != nil || string(v) != "old" {
+		t.Fatalf("GetE after Migrate: got (%q, %v), want old", v, err)
+	}
+}
+
+func TestIncrementAndModify(t *testing.T) {
+	path, b := newTempBucket(t)
+	other, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// Two Buckets on one file behave like two processes.
+	var wg sync.WaitGroup
+	for _, bucket := range []*blockbucketgo.Bucket{b, other} {
+		for g := 0; g < 4; g++ {
+			wg.Go(func() {
+				for i := 0; i < 25; i++ {
+					if _, err := bucket.Increment([]byte("hits"), 2); err != nil {
+						t.Error(err)
+					}
+				}
+			})
+		}
+	}
+	wg.Wait()
+	if n, err := b.Increment([]byte("hits"), -1); err != nil || n != 399 {
+		t.Fatalf("Increment: got (%d, %v) want 399", n, err)
+	}
+
+	if _, err = b.Set(blockbucketgo.Item{Key: []byte("name"), Data: []byte("abc")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if _, err = b.Increment([]byte("name"), 1); !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("Increment of a non-counter: got %v, want strconv.ErrSyntax", err)
+	}
+
+	err = b.Modify([]byte("name"), func(old []byte) ([]byte, error) {
+		return append(old, "def"...), nil
+	})
+	if err != nil {
+		t.Fatalf("Modify error: %v", err)
+	}
+	errAbort := errors.New("abort")
+	err = b.Modify([]byte("name"), func([]byte) ([]byte, error) { return nil, errAbort })
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Modify with error: got %v, want errAbort", err)
+	}
+	if v, err := b.GetE([]byte("name")); err != nil || string(v) != "abcdef" {
+		t.Fatalf("GetE after Modify: got (%q, %v) want abcdef", v, err)
+	}
+}
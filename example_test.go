@@ -10,6 +10,7 @@ import (
 func ExampleBucket_Set_and_Get() {
 	path := "example.db"
 	defer os.Remove(path)
+	defer os.Remove(path + "-wal")
 
 	b := blockbucketgo.New(path)
 	defer b.Close()
@@ -29,6 +30,7 @@ func ExampleBucket_Set_and_Get() {
 func ExampleBucket_ListLockDelete_queueStyle() {
 	path := "queue.db"
 	defer os.Remove(path)
+	defer os.Remove(path + "-wal")
 
 	b := blockbucketgo.New(path)
 	defer b.Close()
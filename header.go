@@ -0,0 +1,199 @@
+package blockbucketgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Files start with a format header that identifies them as bucket files:
+//
+//	magic "BBKT" | version u16 | reserved u16 | features u32 | created unix ns i64 | crc32 u32
+//
+// Files written before the format header existed are version 0. They are
+// opened in compatibility mode and upgraded by Migrate.
+const (
+	formatMagic   = "BBKT"
+	formatVersion = 2
+	formatSize    = 24
+)
+
+// versionFeatures are the header flags of the lists written by each format
+// version. Version 1 lists use the digit encoding, version 2 lists the varint
+// encoding.
+var versionFeatures = [...]uint32{
+	1: flagHash64,
+	2: flagHash64 | flagVarintIndex,
+}
+
+// formatFeatures are the header flags of the lists written by this version.
+var formatFeatures = versionFeatures[formatVersion]
+
+// superblock is the decoded format header.
+type superblock struct {
+	version  uint16
+	features uint32
+	created  time.Time
+}
+
+func encodeSuperblock(sb superblock) []byte {
+	buf := make([]byte, 0, formatSize)
+	buf = append(buf, formatMagic...)
+	buf = binary.LittleEndian.AppendUint16(buf, sb.version)
+	buf = binary.LittleEndian.AppendUint16(buf, 0)
+	buf = binary.LittleEndian.AppendUint32(buf, sb.features)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(sb.created.UnixNano()))
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeSuperblock reads the format header. It reports ok == false for files
+// without one, and an error when the header is damaged or describes a format
+// this version cannot read.
+func decodeSuperblock(buffer []byte) (sb superblock, ok bool, err error) {
+	if !hasMagic(buffer) {
+		return superblock{}, false, nil
+	}
+	sumOff := formatSize - 4
+	if len(buffer) < formatSize ||
+		crc32.ChecksumIEEE(buffer[:sumOff]) != binary.LittleEndian.Uint32(buffer[sumOff:]) {
+		return superblock{}, false, fmt.Errorf(
+			"%w: format header does not match its checksum",
+			ErrCorrupt,
+		)
+	}
+	sb = superblock{
+		version:  binary.LittleEndian.Uint16(buffer[4:]),
+		features: binary.LittleEndian.Uint32(buffer[8:]),
+		created:  time.Unix(0, int64(binary.LittleEndian.Uint64(buffer[12:]))),
+	}
+	if sb.version == 0 || sb.version > formatVersion {
+		return superblock{}, false, fmt.Errorf(
+			"%w: format version %d is not supported",
+			ErrInvalidFormat,
+			sb.version,
+		)
+	}
+	if unknown := sb.features &^ versionFeatures[sb.version]; unknown != 0 {
+		return superblock{}, false, fmt.Errorf(
+			"%w: unknown feature flags %#x",
+			ErrInvalidFormat,
+			unknown,
+		)
+	}
+	return sb, true, nil
+}
+
+func hasMagic(buffer []byte) bool {
+	return bytes.HasPrefix(buffer, []byte(formatMagic))
+}
+
+// The first cFirstSize bytes of the file hold the headers. Files written by
+// older versions keep a single digit-encoded header at offset 0 (see
+// parseHeader). Commits now write one of two slots after the format header
+// instead, alternating between them:
+//
+//	seq u64 | start u64 | size u64 | flags u32 | list crc32 u32 | crc32 u32
+//
+// The valid slot with the highest sequence number wins. If it is torn, or the
+// list it points to does not match its checksum, readers fall back to the other
+// slot: a commit never overwrites the list or the blocks of the commit before it.
+const (
+	cSlotA    uint = 32
+	cSlotB    uint = 80
+	cSlotSize      = 36
+)
+
+// Header flags describe how the list of a slot is encoded.
+const (
+	// flagHash64 lists identify keys by a 64-bit FNV-1a hash (see keyInfo).
+	flagHash64 uint32 = 1 << iota
+	// flagVarintIndex lists use the varint record encoding (see pushBlockToVarint).
+	flagVarintIndex
+)
+
+// header describes one committed index list.
+type header struct {
+	seq     uint64
+	start   uint
+	size    uint
+	flags   uint32
+	listCrc uint32
+	// legacy is set for the digit-encoded header of older files.
+	legacy bool
+}
+
+// emptyHeader stands for a file without any commit. Its flags are the features
+// recorded in the format header, so the first list uses the file's encoding.
+func (e *Bucket) emptyHeader() header {
+	return header{start: cFirstSize, flags: e.format.features}
+}
+
+func slotOffset(seq uint64) uint {
+	if seq%2 == 0 {
+		return cSlotA
+	}
+	return cSlotB
+}
+
+func encodeSlot(h header) []byte {
+	buf := make([]byte, 0, cSlotSize)
+	buf = binary.LittleEndian.AppendUint64(buf, h.seq)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.start))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.size))
+	buf = binary.LittleEndian.AppendUint32(buf, h.flags)
+	buf = binary.LittleEndian.AppendUint32(buf, h.listCrc)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func decodeSlot(buf []byte) (header, bool) {
+	if len(buf) < cSlotSize {
+		return header{}, false
+	}
+	buf = buf[:cSlotSize]
+	if crc32.ChecksumIEEE(buf[:cSlotSize-4]) != binary.LittleEndian.Uint32(buf[cSlotSize-4:]) {
+		return header{}, false
+	}
+	h := header{
+		seq:     binary.LittleEndian.Uint64(buf),
+		start:   uint(binary.LittleEndian.Uint64(buf[8:])),
+		size:    uint(binary.LittleEndian.Uint64(buf[16:])),
+		flags:   binary.LittleEndian.Uint32(buf[24:]),
+		listCrc: binary.LittleEndian.Uint32(buf[28:]),
+	}
+	return h, h.seq > 0 && h.start >= cFirstSize
+}
+
+// decodeHeaders returns the candidate headers found in the header region,
+// newest first. Version 0 files without a valid slot yield their legacy header,
+// if any.
+func decodeHeaders(buffer []byte) []header {
+	var headers []header
+	if a, ok := decodeSlot(buffer[min(cSlotA, uint(len(buffer))):]); ok {
+		headers = append(headers, a)
+	}
+	if b, ok := decodeSlot(buffer[min(cSlotB, uint(len(buffer))):]); ok {
+		if len(headers) > 0 && headers[0].seq > b.seq {
+			headers = append(headers, b)
+		} else {
+			headers = append([]header{b}, headers...)
+		}
+	}
+	if len(headers) > 0 {
+		return headers
+	}
+	if hasMagic(buffer) {
+		return nil
+	}
+	if start, size, ok := parseHeader(buffer); ok && start >= cFirstSize {
+		return []header{{start: start, size: size, legacy: true}}
+	}
+	return nil
+}
+
+// listEnd returns the end of the file range used by the list, including the
+// cEnd terminator.
+func (h header) listEnd() uint {
+	return h.start + h.size + 1
+}
@@ -0,0 +1,347 @@
+package blockbucketgo_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+// legacyDigits encodes n the way the legacy format does, one digit per byte.
+func legacyDigits(n int) []byte {
+	var out []byte
+	for _, c := range strconv.Itoa(n) {
+		out = append(out, byte(c-'0'))
+	}
+	return out
+}
+
+// writeLegacyFile writes a data file in the format used before header slots,
+// holding a single key/value pair.
+func writeLegacyFile(t *testing.T, path string, key, data string) {
+	t.Helper()
+	var sumKey, sumMd5 int
+	for i := 0; i < len(key); i++ {
+		sumKey += int(key[i])
+	}
+	sum := md5.Sum([]byte(key))
+	for _, c := range []byte(hex.EncodeToString(sum[:])) {
+		sumMd5 += int(c)
+	}
+	var list []byte
+	for i, n := range []int{128, len(key), sumKey, sumMd5, len(data)} {
+		list = append(list, legacyDigits(n)...)
+		list = append(list, byte(250+i))
+	}
+	start := 128 + len(key) + len(data)
+
+	file := make([]byte, 128)
+	head := append(legacyDigits(start), 255)
+	head = append(head, legacyDigits(len(list))...)
+	copy(file, append(head, 255))
+	file = append(file, key+data...)
+	file = append(file, list...)
+	file = append(file, 255)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	writeLegacyFile(t, path, "old-key", "old-value")
+
+	b, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("Open legacy file: %v", err)
+	}
+	if v, err := b.GetE([]byte("old-key")); err != nil || string(v) != "old-value" {
+		t.Fatalf("GetE legacy key: got (%q, %v)", v, err)
+	}
+	if _, err = b.Set(blockbucketgo.Item{Key: []byte("new-key"), Data: []byte("new-value")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	b.Close()
+
+	b, err = blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer b.Close()
+	items, err := b.ListE(10)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("ListE after upgrade: got (%d items, %v) want 2", len(items), err)
+	}
+}
+
+func TestTornHeaderSlotFallsBack(t *testing.T) {
+	path, b := newTempBucket(t)
+
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("a"), Data: []byte("1")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("b"), Data: []byte("2")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	b.Close()
+
+	// The second commit went to the slot at offset 32; tear it.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteAt([]byte{0xde, 0xad}, 40)
+	_ = f.Close()
+
+	b2, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("Open with torn slot: %v", err)
+	}
+	defer b2.Close()
+	if v, err := b2.GetE([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("GetE(a) after fallback: got (%q, %v)", v, err)
+	}
+	if _, err := b2.GetE([]byte("b")); !errors.Is(err, blockbucketgo.ErrNotFound) {
+		t.Fatalf("GetE(b) after fallback: got %v want ErrNotFound", err)
+	}
+	if _, err := b2.Set(blockbucketgo.Item{Key: []byte("c"), Data: []byte("3")}); err != nil {
+		t.Fatalf("Set after fallback: %v", err)
+	}
+	if v, err := b2.GetE([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("GetE(a) after new commit: got (%q, %v)", v, err)
+	}
+}
+
+func TestKeysWithSameByteSum(t *testing.T) {
+	_, b := newTempBucket(t)
+
+	// Same length and byte sum: only the hash tells these keys apart.
+	keys := []string{"ab", "ba", "ca", "ac", "bb"}
+	for i, k := range keys {
+		if _, err := b.Set(blockbucketgo.Item{Key: []byte(k), Data: []byte{byte('0' + i)}}); err != nil {
+			t.Fatalf("Set(%q) error: %v", k, err)
+		}
+	}
+	for i, k := range keys {
+		if v, err := b.GetE([]byte(k)); err != nil || string(v) != string(rune('0'+i)) {
+			t.Fatalf("GetE(%q): got (%q, %v)", k, v, err)
+		}
+	}
+	if _, err := b.Delete([]byte("ba")); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	if items, err := b.ListE(10); err != nil || len(items) != len(keys)-1 {
+		t.Fatalf("ListE after delete: got (%d items, %v)", len(items), err)
+	}
+}
+
+func TestFormatHeader(t *testing.T) {
+	path, b := newTempBucket(t)
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw[:4]) != "BBKT" {
+		t.Fatalf("new file starts with %q, want magic BBKT", raw[:4])
+	}
+
+	// A newer format version must be refused rather than misread.
+	newer := slices.Clone(raw)
+	binary.LittleEndian.PutUint16(newer[4:], 99)
+	binary.LittleEndian.PutUint32(newer[20:], crc32.ChecksumIEEE(newer[:20]))
+	newerPath := filepath.Join(t.TempDir(), "newer.db")
+	if err = os.WriteFile(newerPath, newer, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = blockbucketgo.Open(newerPath); !errors.Is(err, blockbucketgo.ErrInvalidFormat) {
+		t.Fatalf("Open newer version: got %v, want ErrInvalidFormat", err)
+	}
+}
+
+func TestMigrateLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	writeLegacyFile(t, path, "old-key", "old-value")
+
+	if err := blockbucketgo.Migrate(path); err != nil {
+		t.Fatalf("Migrate error: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw[:4]) != "BBKT" {
+		t.Fatalf("migrated file starts with %q, want magic BBKT", raw[:4])
+	}
+	if err = blockbucketgo.Migrate(path); err != nil {
+		t.Fatalf("second Migrate error: %v", err)
+	}
+	if again, _ := os.ReadFile(path); !bytes.Equal(again, raw) {
+		t.Fatalf("second Migrate changed the file")
+	}
+
+	b, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("Open migrated file: %v", err)
+	}
+	defer b.Close()
+	if v, err := b.GetE([]byte("old-key")); err != nil || string(v) != "old-value" {
+		t.Fatalf("GetE after Migrate: got (%q, %v)", v, err)
+	}
+	if _, err = b.Set(blockbucketgo.Item{Key: []byte("new-key"), Data: []byte("new-value")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if items, err := b.ListE(10); err != nil || len(items) != 2 {
+		t.Fatalf("ListE after Migrate: got (%d items, %v) want 2", len(items), err)
+	}
+}
+
+func TestFormatVersion1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v1.db")
+	b, err := blockbucketgo.Open(path, blockbucketgo.FormatVersion(1))
+	if err != nil {
+		t.Fatalf("Open version 1: %v", err)
+	}
+	if n := b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("a"), Data: []byte("1")},
+		{Key: []byte("b"), Data: []byte("2")},
+	}); n != 2 {
+		t.Fatalf("SetMany: got %d want 2", n)
+	}
+	b.Close()
+
+	_, err = blockbucketgo.Open(filepath.Join(t.TempDir(), "v9.db"), blockbucketgo.FormatVersion(9))
+	if !errors.Is(err, blockbucketgo.ErrInvalidFormat) {
+		t.Fatalf("Open version 9: got %v, want ErrInvalidFormat", err)
+	}
+
+	if err = blockbucketgo.Migrate(path); err != nil {
+		t.Fatalf("Migrate error: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := binary.LittleEndian.Uint16(raw[4:]); v != 2 {
+		t.Fatalf("format version after Migrate: got %d want 2", v)
+	}
+	b, err = blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("Open migrated file: %v", err)
+	}
+	defer b.Close()
+	items, err := b.ListE(10)
+	if err != nil || len(items) != 2 || string(items[1].Data) != "2" {
+		t.Fatalf("ListE after Migrate: got (%v, %v)", items, err)
+	}
+}
+
+// TestNeedsMigration lists the operations that need metadata only format 2
+// files can store.
+func TestNeedsMigration(t *testing.T) {
+	b, err := blockbucketgo.Open(
+		filepath.Join(t.TempDir(), "v1.db"),
+		blockbucketgo.FormatVersion(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")})
+
+	for name, op := range map[string]func() error{
+		"SetIfVersion": func() error {
+			_, err := b.SetIfVersion(blockbucketgo.Item{Key: []byte("new")}, 0)
+			return err
+		},
+		"Lease": func() error {
+			_, err := b.Lease(1, time.Minute)
+			return err
+		},
+		"SetDelayed": func() error {
+			_, err := b.SetDelayed(blockbucketgo.Item{Key: []byte("new")}, time.Now())
+			return err
+		},
+		"Set with a priority": func() error {
+			_, err := b.Set(blockbucketgo.Item{Key: []byte("new"), Priority: 1})
+			return err
+		},
+		"Update with a priority": func() error {
+			return b.Update(func(tx *blockbucketgo.Tx) error {
+				return tx.Set(blockbucketgo.Item{Key: []byte("new"), Priority: 1})
+			})
+		},
+	} {
+		if err := op(); !errors.Is(err, blockbucketgo.ErrNeedsMigration) {
+			t.Errorf("%s on format 1: got %v, want ErrNeedsMigration", name, err)
+		}
+	}
+	if items, err := b.ListE(10); err != nil || len(items) != 1 {
+		t.Fatalf("ListE after the failed writes: got (%q, %v), want only k", items, err)
+	}
+}
+
+// BenchmarkIndexEncoding compares the digit encoded index list of version 1
+// with the varint list of version 2: "set" encodes the list on every commit,
+// "load" decodes it when the file is opened.
+func BenchmarkIndexEncoding(b *testing.B) {
+	items := make([]blockbucketgo.Item, 10000)
+	for i := range items {
+		items[i] = blockbucketgo.Item{Key: []byte("key-" + strconv.Itoa(i)), Data: []byte("value")}
+	}
+	for _, version := range []int{1, 2} {
+		path := filepath.Join(b.TempDir(), "data.db")
+		bucket, err := blockbucketgo.Open(
+			path,
+			blockbucketgo.FormatVersion(version),
+			blockbucketgo.Sync(blockbucketgo.SyncNone),
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bucket.SetMany(items)
+		bucket.Close()
+		info, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run("v"+strconv.Itoa(version)+"/load", func(b *testing.B) {
+			for b.Loop() {
+				bucket, err := blockbucketgo.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = bucket.GetE(items[0].Key); err != nil {
+					b.Fatal(err)
+				}
+				bucket.Close()
+			}
+			b.ReportMetric(float64(info.Size()), "file-bytes")
+		})
+		b.Run("v"+strconv.Itoa(version)+"/set", func(b *testing.B) {
+			bucket, err := blockbucketgo.Open(path, blockbucketgo.Sync(blockbucketgo.SyncNone))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer bucket.Close()
+			for i := 0; b.Loop(); i++ {
+				if _, err = bucket.Set(items[i%len(items)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -6,7 +6,10 @@
 //
 // Typical usage:
 //
-//	b := blockbucketgo.New("data.db")
+//	b, err := blockbucketgo.Open("data.db")
+//	if err != nil {
+//		return err
+//	}
 //	defer b.Close()
 //
 //	_, _ = b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")})
@@ -18,15 +21,23 @@ package blockbucketgo
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
 	"math"
 	"os"
 	"slices"
 	"sort"
 	"sync"
 	"syscall"
+	"time"
 )
 
 const (
@@ -40,15 +51,229 @@ const (
 	cFirstSize     uint  = 128
 )
 
+// lockMaxBackoff is the longest pause between two attempts to take the file lock.
+const lockMaxBackoff = 50 * time.Millisecond
+
+// ErrInvalidFormat is reported by Open when the file is not a bucket data file.
+var ErrInvalidFormat = errors.New("blockbucketgo: invalid file format")
+
+// ErrNotFound is returned by GetE when the key is not stored in the bucket.
+var ErrNotFound = errors.New("blockbucketgo: key not found")
+
+// ErrReadOnly is returned by the writes of a Bucket opened with ReadOnly.
+var ErrReadOnly = errors.New("blockbucketgo: bucket is read-only")
+
+// ErrLocked is reported by Open with Exclusive when another Bucket holds the file.
+var ErrLocked = errors.New("blockbucketgo: file is locked by another bucket")
+
+// ErrLockTimeout is returned when the file lock could not be taken before the
+// context of the call was done or the LockTimeout expired. The error also
+// matches the context error.
+var ErrLockTimeout = errors.New("blockbucketgo: timed out waiting for the file lock")
+
+// ErrConflict is returned by SetIfVersion when the stored version of the key
+// is not the expected one.
+var ErrConflict = errors.New("blockbucketgo: version conflict")
+
+// ErrNeedsMigration is returned by operations that need metadata which files
+// of older format versions cannot store. Migrate upgrades such files.
+var ErrNeedsMigration = errors.New(
+	"blockbucketgo: operation needs the current file format, see Migrate",
+)
+
+// ErrCorrupt is returned when the index list or a block it points to cannot be decoded.
+var ErrCorrupt = errors.New("blockbucketgo: corrupted data")
+
+// ErrClosed is returned by the reads and writes of a Bucket after Close.
+var ErrClosed = errors.New("blockbucketgo: bucket is closed")
+
+// OpenError records a failed Open together with the step and the path that failed.
+//
+// Op is one of "open", "lock", "recover" or "validate". Err is the underlying cause, so
+// errors.Is(err, fs.ErrPermission) and errors.Is(err, ErrInvalidFormat) work as expected.
+type OpenError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *OpenError) Error() string {
+	return "blockbucketgo: " + e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *OpenError) Unwrap() error { return e.Err }
+
+// Option configures a Bucket opened with Open.
+type Option func(*options)
+
+type options struct {
+	perm          os.FileMode
+	sync          SyncMode
+	syncEvery     time.Duration
+	version       int
+	readOnly      bool
+	exclusive     bool
+	lockTimeout   time.Duration
+	maxDeliveries int
+}
+
+// FileMode sets the permission bits used when Open creates the data file.
+// The default is 0o644.
+func FileMode(perm os.FileMode) Option {
+	return func(o *options) {
+		o.perm = perm
+	}
+}
+
+// FormatVersion sets the format version of the file Open creates. It has no
+// effect on existing files, see Migrate. The default is the latest version, 2;
+// version 1 keeps the digit-encoded index list of earlier releases.
+func FormatVersion(v int) Option {
+	return func(o *options) {
+		o.version = v
+	}
+}
+
+// ReadOnly opens an existing file for reading only. No write handle is opened
+// and reads take shared locks only, so the file may live on a read-only mount.
+// Writes fail with ErrReadOnly.
+//
+// A read-only Bucket does not replay the write-ahead log: it sees the last
+// commit that reached the data file.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// Exclusive makes the Bucket the only user of the file until Close: Open takes
+// the file lock once, failing with ErrLocked when another Bucket, in this
+// process or another one, is using the file. Reads and writes then skip the
+// per-call file locking, and the index is kept in memory without checking the
+// file for commits of other processes.
+//
+// Buckets opened without Exclusive wait for the lock until the exclusive one
+// is closed. Combined with ReadOnly the Bucket holds a shared lock: other
+// read-only Buckets may use the file, writers wait.
+func Exclusive() Option {
+	return func(o *options) {
+		o.exclusive = true
+	}
+}
+
+// LockTimeout bounds how long Open and each call wait for the file lock held
+// by another process. Calls that time out return ErrLockTimeout. By default
+// they wait as long as their context allows, which for the variants without a
+// context is forever.
+func LockTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.lockTimeout = d
+	}
+}
+
+// MaxDeliveries moves an item to the dead letters once Lease handed it out n
+// times without an Ack, instead of delivering it again. The default, 0, never
+// gives up on an item. See DeadLetters.
+func MaxDeliveries(n int) Option {
+	return func(o *options) {
+		o.maxDeliveries = n
+	}
+}
+
+// SyncMode controls when commits are flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncCommit syncs the write-ahead log before each write returns, so an
+	// acknowledged write survives a power loss. It is the default.
+	SyncCommit SyncMode = iota
+	// SyncNone never syncs on commit and leaves write-back to the OS. After a
+	// power loss the last writes may be lost, and since blocks carry no
+	// checksum, the index may point at blocks whose data never reached the disk.
+	SyncNone
+	// SyncInterval syncs the write-ahead log in the background at a fixed
+	// interval (group commit). A power loss between two syncs has the same
+	// effects as with SyncNone.
+	SyncInterval
+)
+
+// Sync sets the SyncMode used by writes that do not override it.
+func Sync(mode SyncMode) Option {
+	return func(o *options) {
+		o.sync = mode
+	}
+}
+
+// SyncEvery selects SyncInterval and syncs the write-ahead log every d.
+func SyncEvery(d time.Duration) Option {
+	return func(o *options) {
+		o.sync = SyncInterval
+		o.syncEvery = d
+	}
+}
+
+// WriteOption configures a single write.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	sync SyncMode
+}
+
+// WriteSync overrides the Bucket SyncMode for one write. With SyncCommit the
+// write, and every write committed before it, is durable when the call returns.
+func WriteSync(mode SyncMode) WriteOption {
+	return func(o *writeOptions) {
+		o.sync = mode
+	}
+}
+
 // Bucket represents an opened on-disk store.
 //
-// A Bucket is backed by a file path provided to New.
+// A Bucket is backed by a file path provided to Open.
 // Always call Close when done.
 type Bucket struct {
-	reader *os.File
-	writer *os.File
-	fd     uintptr
-	mu     sync.Mutex
+	path    string
+	perm    os.FileMode
+	reader  *os.File
+	writer  *os.File
+	wal     *os.File
+	fd      uintptr
+	mu      sync.RWMutex
+	head    header
+	pending []walWrite
+	next    *index
+	format  superblock
+	// closed is set by Close, under mu.
+	closed bool
+
+	readOnly bool
+	// exclusive is set when the file lock is held from Open to Close.
+	exclusive     bool
+	lockTimeout   time.Duration
+	maxDeliveries int
+
+	cacheMu sync.Mutex
+	cache   *index
+
+	// shareMu guards shared, the number of readers holding the shared file lock.
+	shareMu sync.Mutex
+	shared  int
+
+	// viewMu guards views, the number of open Views, and viewFile, which
+	// holds the shared lock on the view file while views is not 0.
+	viewMu   sync.Mutex
+	views    int
+	viewFile *os.File
+
+	// notifyMu guards notify, which is closed by the next commit of this
+	// Bucket to wake WaitAndConsume.
+	notifyMu sync.Mutex
+	notify   chan struct{}
+
+	sync      SyncMode
+	walDirty  bool
+	stopSync  chan struct{}
+	syncGroup sync.WaitGroup
 }
 
 // Item is a single key/value entry stored in the bucket.
@@ -57,6 +282,19 @@ type Item struct {
 	Key []byte
 	// Data is the payload/value (arbitrary bytes).
 	Data []byte
+	// Version is set on read items of format 2 files: it grows every time
+	// the key is written. Writes ignore it, see SetIfVersion.
+	Version uint64
+	// Deliveries is set on read items: the number of times Lease handed the
+	// item out.
+	Deliveries int
+	// NotBefore is set on read items stored by SetDelayed: the time before
+	// which they are not listed nor consumed.
+	NotBefore time.Time
+	// Priority orders consumption: ListLockDelete and Lease hand out the
+	// items with the highest priority first, oldest first within a priority.
+	// Items default to 0. Only format 2 files store priorities.
+	Priority int
 }
 
 type block struct {
@@ -65,6 +303,17 @@ type block struct {
 	sumKey   uint
 	sumMd5   uint
 	sizeData uint
+	// version and the lease fields are only stored by flagVarintIndex lists.
+	version uint64
+	// leaseUntil is the time, in Unix nanoseconds, until which the block is
+	// hidden from consumers by the lease leaseID.
+	leaseUntil uint64
+	leaseID    uint64
+	deliveries uint64
+	notBefore  uint64
+	priority   int64
+	// dead blocks are dead letters, outside the namespace of the other keys.
+	dead bool
 }
 
 var emptyBlock = block{
@@ -77,42 +326,305 @@ var emptyBlock = block{
 
 // Close flushes and closes any underlying file handles.
 //
-// It is safe to call Close multiple times only if your implementation supports it
-// (otherwise document the behavior here).
+// Commits still in the write-ahead log are checkpointed into the data file first.
+// Calling Close more than once is a no-op. Later calls, and WaitAndConsume calls
+// waiting when Close runs, return ErrClosed.
 func (e *Bucket) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	stopSync := e.stopSync
+	e.stopSync = nil
+	e.mu.Unlock()
+	// The sync loop takes e.mu: stop it without holding the lock.
+	if stopSync != nil {
+		close(stopSync)
+		e.syncGroup.Wait()
+	}
+
+	defer e.signal()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.wal != nil && e.writer != nil {
+		// If the lock cannot be taken the log is replayed by the next Open.
+		if e.lockFile(context.Background(), syscall.LOCK_EX) == nil {
+			_ = e.checkpoint()
+			e.unlockFile()
+		}
+	}
+	e.closeFiles()
+}
+
+func (e *Bucket) closeFiles() {
+	if e.wal != nil {
+		_ = e.wal.Close()
+		e.wal = nil
+	}
 	if e.reader != nil {
 		_ = e.reader.Close()
+		e.reader = nil
 	}
 	if e.writer != nil {
 		_ = e.writer.Close()
+		e.writer = nil
 	}
 }
 
-// New opens (or creates) a bucket at the given file path.
+// Open opens (or creates) a bucket at the given file path.
+//
+// Failures are reported as *OpenError: the file cannot be opened (including
+// permission errors), its lock cannot be taken, its write-ahead log cannot be
+// replayed, or its header is not a valid bucket header (ErrInvalidFormat).
+//
+// Commits left in the write-ahead log by a process that crashed are replayed
+// into the data file before Open returns.
 //
 // The returned Bucket keeps file handles open until Close is called.
+func Open(path string, opts ...Option) (*Bucket, error) {
+	o := options{perm: 0o644, version: formatVersion}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	e := Bucket{
+		path:          path,
+		perm:          o.perm,
+		readOnly:      o.readOnly,
+		lockTimeout:   o.lockTimeout,
+		maxDeliveries: o.maxDeliveries,
+		sync:          o.sync,
+	}
+	if e.readOnly {
+		reader, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, &OpenError{Op: "open", Path: path, Err: err}
+		}
+		e.reader = reader
+		e.fd = reader.Fd()
+	} else {
+		reader, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, o.perm)
+		if err != nil {
+			return nil, &OpenError{Op: "open", Path: path, Err: err}
+		}
+		e.reader = reader
+		writer, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, o.perm)
+		if err != nil {
+			e.closeFiles()
+			return nil, &OpenError{Op: "open", Path: path, Err: err}
+		}
+		e.writer = writer
+		e.fd = writer.Fd()
+	}
+
+	if o.exclusive {
+		how := syscall.LOCK_EX
+		if e.readOnly {
+			how = syscall.LOCK_SH
+		}
+		if err := syscall.Flock(int(e.fd), how|syscall.LOCK_NB); err != nil {
+			e.closeFiles()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				err = ErrLocked
+			}
+			return nil, &OpenError{Op: "lock", Path: path, Err: err}
+		}
+		e.exclusive = true
+	}
+
+	if op, err := e.prepare(o.version); err != nil {
+		e.closeFiles()
+		return nil, &OpenError{Op: op, Path: path, Err: err}
+	}
+	if e.sync == SyncInterval && !e.readOnly {
+		e.startSyncLoop(o.syncEvery)
+	}
+	return &e, nil
+}
+
+// prepare replays the write-ahead log and validates the file under the
+// exclusive lock, or only validates it under the shared lock when read-only.
+// It returns the failing Open step with the error.
+func (e *Bucket) prepare(version int) (string, error) {
+	if e.readOnly {
+		if err := e.lockFile(context.Background(), syscall.LOCK_SH); err != nil {
+			return "lock", err
+		}
+		defer e.unlockFile()
+		if err := e.validate(); err != nil {
+			return "validate", err
+		}
+		return "", nil
+	}
+	if err := e.lockFile(context.Background(), syscall.LOCK_EX); err != nil {
+		return "lock", err
+	}
+	defer e.unlockFile()
+
+	err := e.openWal()
+	if err == nil && e.wal != nil {
+		err = e.replayWal()
+	}
+	if err != nil {
+		return "recover", err
+	}
+	if err = e.create(version); err != nil {
+		return "open", err
+	}
+	if err = e.validate(); err != nil {
+		return "validate", err
+	}
+	return "", nil
+}
+
+// New opens (or creates) a bucket at the given file path.
+//
+// It is kept for compatibility and returns nil when Open fails; use Open to
+// find out why.
 //
 // Example:
 //
 //	b := blockbucketgo.New("data.db")
 //	defer b.Close()
 func New(path string) *Bucket {
-	e := Bucket{}
-	reader, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o644)
+	e, err := Open(path)
 	if err != nil {
 		return nil
 	}
-	e.reader = reader
-	writer, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	return e
+}
+
+// create writes the format header of a new, empty file.
+func (e *Bucket) create(version int) error {
+	info, err := e.reader.Stat()
+	if err != nil || info.Size() > 0 {
+		return err
+	}
+	if version < 1 || version > formatVersion {
+		return fmt.Errorf("%w: format version %d is not supported", ErrInvalidFormat, version)
+	}
+	e.writeAt(encodeSuperblock(superblock{
+		version:  uint16(version),
+		features: versionFeatures[version],
+		created:  time.Now(),
+	}), 0)
+	if err = e.commit(SyncCommit); err != nil {
+		return err
+	}
+	// The file was most likely just created by Open.
+	return syncDir(e.path)
+}
+
+// validate checks that the file has a bucket header and that the list it
+// points to can be read. Files without a format header are accepted in
+// compatibility mode.
+func (e *Bucket) validate() error {
+	buffer := make([]byte, cFirstSize)
+	n, err := e.reader.ReadAt(buffer, 0)
+	if n == 0 && errors.Is(err, io.EOF) {
+		// An empty file opened read-only.
+		return nil
+	}
+	if err != nil && n == 0 {
+		return err
+	}
+	sb, ok, err := decodeSuperblock(buffer[:n])
+	if err != nil {
+		return err
+	}
+	if ok {
+		e.format = sb
+	} else if len(decodeHeaders(buffer[:n])) == 0 {
+		return ErrInvalidFormat
+	}
+	_, _, err = e.getListConfig()
+	return err
+}
+
+// Migrate upgrades the data file at path in place to the current format
+// version: the index list is rewritten with the current key hash and encoding,
+// and the format header is written, in a single commit. Files already in the
+// current version are left untouched.
+//
+// Files written by older versions can still be opened without migrating, but
+// new features may require the current format.
+func Migrate(path string, opts ...Option) error {
+	e, err := Open(path, opts...)
 	if err != nil {
+		return err
+	}
+	defer e.Close()
+	return e.migrate()
+}
+
+func (e *Bucket) migrate() error {
+	opts := []WriteOption{WriteSync(SyncCommit)}
+	return e.update(context.Background(), opts, func(idx *index) error {
+		buffer, err := e.readHeaderRegion()
+		if err != nil {
+			return err
+		}
+		sb, ok, err := decodeSuperblock(buffer)
+		if err != nil || (ok && sb.version == formatVersion) {
+			return err
+		}
+
+		// Older lists have no versions: the items get the version of the
+		// migration commit, so that no stored item has version 0.
+		version := nextVersion(header{seq: idx.head.seq, flags: formatFeatures})
+		listBlock := make([]block, 0, len(idx.listBlock))
+		for i := 0; i < len(idx.listBlock); i++ {
+			item, live, err := e.pullItem(idx.listBlock[i], idx.head.flags)
+			if err != nil {
+				return err
+			}
+			if !live {
+				continue
+			}
+			info := e.keyInfo(item.Key, formatFeatures)
+			info.start = idx.listBlock[i].start
+			info.sizeData = idx.listBlock[i].sizeData
+			info.version = version
+			listBlock = append(listBlock, info)
+		}
+		e.format = superblock{version: formatVersion, features: formatFeatures, created: time.Now()}
+		if ok {
+			e.format.created = sb.created
+		}
+		e.head.flags = formatFeatures
+		e.updateListBlock(e.newSpaceAllocator(idx.listBlock), listBlock)
+		e.writeAt(encodeSuperblock(e.format), 0)
 		return nil
+	})
+}
+
+// parseHeader splits the legacy header into its start and size digit groups.
+func parseHeader(buffer []byte) (start uint, size uint, ok bool) {
+	var startListData []byte
+	var sizeListData []byte
+	var positionListCheck uint8
+	for i := 0; i < len(buffer) && positionListCheck < 2; i++ {
+		v := buffer[i]
+		switch {
+		case v == cEnd:
+			positionListCheck += 1
+		case v > cMaxDigitGroup:
+			return 0, 0, false
+		case positionListCheck == 0:
+			startListData = append(startListData, v)
+		default:
+			sizeListData = append(sizeListData, v)
+		}
 	}
-	e.writer = writer
-	e.fd = writer.Fd()
-	return &e
+	if positionListCheck < 2 {
+		return 0, 0, false
+	}
+	return digitsToNumber(startListData), digitsToNumber(sizeListData), true
 }
 
-func (e *Bucket) digitsToNumber(digits []byte) (n uint) {
+func digitsToNumber(digits []byte) (n uint) {
 	for i := 0; i < len(digits); i++ {
 		x := digits[i]
 		var count int
@@ -132,160 +644,495 @@ func (e *Bucket) digitsToNumber(digits []byte) (n uint) {
 //
 // It returns n (implementation-defined; commonly bytes written or affected records)
 // and a non-nil error on failure.
-func (e *Bucket) Set(item Item) (int, error) {
-	_ = syscall.Flock(int(e.fd), syscall.LOCK_EX)
-	defer syscall.Flock(int(e.fd), syscall.LOCK_UN)
+func (e *Bucket) Set(item Item, opts ...WriteOption) (n int, err error) {
+	return e.SetCtx(context.Background(), item, opts...)
+}
+
+// SetCtx is like Set but gives up waiting for the file lock when ctx is done,
+// returning ErrLockTimeout.
+func (e *Bucket) SetCtx(ctx context.Context, item Item, opts ...WriteOption) (n int, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		n, err = e.setOneData(idx, item)
+		return err
+	})
+	return n, err
+}
+
+// update runs fn on the current index with the file locked, then commits the
+// writes fn queued with writeAt through the write-ahead log. It gives up
+// waiting for the file lock when ctx is done.
+func (e *Bucket) update(ctx context.Context, opts []WriteOption, fn func(idx *index) error) error {
+	if e.readOnly {
+		return ErrReadOnly
+	}
+	o := writeOptions{sync: e.sync}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// flock locks belong to the file description, which all goroutines
+	// share: hold e.mu exclusively first so that no view converts or releases
+	// the lock of a writer.
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	if err := e.lockFile(ctx, syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer e.unlockFile()
 
-	startListPoint, listBlockData := e.getListConfig()
-	return e.setOneData(
-		listBlockData,
-		item.Key,
-		item.Data,
-		startListPoint,
-	)
+	if !e.exclusive {
+		// Only another process can have left a commit unapplied.
+		if err := e.recoverWal(); err != nil {
+			return err
+		}
+	}
+	idx, err := e.loadIndex()
+	if err != nil {
+		return err
+	}
+	e.head = idx.head
+	e.pending = nil
+	e.next = nil
+	if err = fn(idx); err != nil {
+		e.pending = nil
+		return err
+	}
+	if err = e.commit(o.sync); err != nil {
+		e.setCache(nil)
+		return err
+	}
+	if e.next != nil {
+		e.setCache(e.next)
+		e.signal()
+	}
+	return nil
 }
 
-func (e *Bucket) getListConfig() (uint, []byte) {
-	buffer := make([]byte, cFirstSize)
-	_, _ = e.reader.ReadAt(buffer, 0)
+// view runs fn on the current index with the file share-locked, so no writer,
+// in this process or another one, commits while fn reads the index and the
+// blocks it points to. Any number of views run in parallel.
+func (e *Bucket) view(ctx context.Context, fn func(idx *index) error) error {
+	return e.read(ctx, func() error {
+		idx, err := e.loadIndex()
+		if err != nil {
+			return err
+		}
+		return fn(idx)
+	})
+}
 
-	var startListData []byte
-	var sizeListData []byte
-	func() {
-		var positionListCheck uint8
-		for i := 0; i < len(buffer); i++ {
-			v := buffer[i]
-			if v == cEnd {
-				positionListCheck += 1
-				continue
-			}
-			if positionListCheck == 0 {
-				startListData = append(startListData, v)
-			} else if positionListCheck == 1 {
-				sizeListData = append(sizeListData, v)
-			} else {
-				break
-			}
+// read runs fn with the file share-locked.
+func (e *Bucket) read(ctx context.Context, fn func() error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return ErrClosed
+	}
+	if err := e.rlockFile(ctx); err != nil {
+		return err
+	}
+	defer e.runlockFile()
+	return fn()
+}
+
+// lockFile takes the file lock for Open or a commit. An Exclusive Bucket
+// already holds it.
+//
+// Without a deadline it blocks in flock. Otherwise it polls with a
+// non-blocking flock, backing off up to lockMaxBackoff, until ctx is done or
+// the LockTimeout expires.
+func (e *Bucket) lockFile(ctx context.Context, how int) error {
+	if e.exclusive {
+		return nil
+	}
+	if e.lockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.lockTimeout)
+		defer cancel()
+	}
+	if ctx.Done() == nil {
+		return syscall.Flock(int(e.fd), how)
+	}
+	backoff := time.Millisecond
+	for {
+		err := syscall.Flock(int(e.fd), how|syscall.LOCK_NB)
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return err
 		}
-	}()
-	startListPoint := e.digitsToNumber(startListData)
-	var listBlockData []byte
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ErrLockTimeout, ctx.Err())
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, lockMaxBackoff)
+	}
+}
 
-	func() {
-		if startListPoint < cFirstSize {
-			startListPoint = cFirstSize
-			listBlockData = []byte{}
-		} else {
-			sizeList := e.digitsToNumber(sizeListData)
-			listBlockData = make([]byte, sizeList) // vec![0u8; size_list];
-			_, _ = e.reader.ReadAt(listBlockData, int64(startListPoint))
-			idx := slices.Index(listBlockData, cEnd)
-			if idx > -1 {
-				listBlockData = listBlockData[:idx]
-			}
+func (e *Bucket) unlockFile() {
+	if !e.exclusive {
+		_ = syscall.Flock(int(e.fd), syscall.LOCK_UN)
+	}
+}
+
+// rlockFile takes the shared file lock for a view. The views of a Bucket
+// share one flock: the first view takes it and the last one releases it.
+func (e *Bucket) rlockFile(ctx context.Context) error {
+	if e.exclusive {
+		return nil
+	}
+	e.shareMu.Lock()
+	defer e.shareMu.Unlock()
+	if e.shared == 0 {
+		if err := e.lockFile(ctx, syscall.LOCK_SH); err != nil {
+			return err
 		}
-	}()
-	return startListPoint, listBlockData
+	}
+	e.shared++
+	return nil
 }
 
-func (e *Bucket) setOneData(
-	listBlockData []byte,
-	key []byte,
-	data []byte,
-	startListPoint uint,
-) (int, error) {
-	newListBlockData, newListBlockInfo := e.getNewListNotContainKey(listBlockData, key, true)
-	sizeKey := uint(len(key))
-	sizeData := uint(len(data))
-	blockSize := sizeKey + sizeData
-	var sumKey uint
-	for i := 0; i < len(key); i++ {
-		sumKey += uint(key[i])
+func (e *Bucket) runlockFile() {
+	if e.exclusive {
+		return
 	}
-	var sumMd5 uint
-	keyMd5 := e.md5(key)
-	for i := 0; i < len(keyMd5); i++ {
-		sumMd5 += uint(keyMd5[i])
+	e.shareMu.Lock()
+	defer e.shareMu.Unlock()
+	e.shared--
+	if e.shared == 0 {
+		_ = syscall.Flock(int(e.fd), syscall.LOCK_UN)
 	}
-	listSpace := e.getListSpace(startListPoint, newListBlockInfo)
-	startList, startBlock := e.getPerfectSpace(listSpace, startListPoint, blockSize)
-	infoData := pushBlockToData([]byte{}, &block{
-		start:    startBlock,
-		sizeKey:  sizeKey,
-		sumKey:   sumKey,
-		sumMd5:   sumMd5,
-		sizeData: sizeData,
-	})
-	listBlockDataWriter := append(newListBlockData, infoData...)
-	if n, err := e.updateListBlock(startList, listBlockDataWriter); err != nil {
-		return n, err
+}
+
+// keyHash is the part of a block record that identifies its key.
+type keyHash struct {
+	sizeKey uint
+	sumKey  uint
+	sumMd5  uint
+}
+
+func (b block) keyHash() keyHash {
+	return keyHash{sizeKey: b.sizeKey, sumKey: b.sumKey, sumMd5: b.sumMd5}
+}
+
+// index is a decoded committed index list with its blocks grouped by key hash.
+// It is shared by concurrent readers and never modified once built.
+type index struct {
+	head      header
+	listBlock []block
+	position  map[keyHash][]int
+}
+
+func newIndex(h header, listBlock []block) *index {
+	idx := &index{
+		head:      h,
+		listBlock: slices.Clip(listBlock),
+		position:  make(map[keyHash][]int, len(listBlock)),
+	}
+	for i := 0; i < len(listBlock); i++ {
+		k := listBlock[i].keyHash()
+		idx.position[k] = append(idx.position[k], i)
 	}
-	return e.writer.WriteAt(append(key, data...), int64(startBlock))
+	return idx
 }
 
-func (e *Bucket) md5(input []byte) []byte {
-	hash := md5.New()
-	hash.Write(input)
-	return []byte(hex.EncodeToString(hash.Sum(nil)))
+// loadIndex returns the committed index. The decoded index is cached, and the
+// list is only read and decoded again when the header changed, i.e. when a
+// commit happened since, in this process or another one. An Exclusive Bucket
+// makes every commit itself, so it trusts its cache without reading the header.
+func (e *Bucket) loadIndex() (*index, error) {
+	if e.exclusive {
+		e.cacheMu.Lock()
+		cache := e.cache
+		e.cacheMu.Unlock()
+		if cache != nil {
+			return cache, nil
+		}
+	}
+	buffer, err := e.readHeaderRegion()
+	if err != nil {
+		return nil, err
+	}
+	headers := decodeHeaders(buffer)
+	newest := e.emptyHeader()
+	if len(headers) > 0 {
+		newest = headers[0]
+	}
+	e.cacheMu.Lock()
+	cache := e.cache
+	e.cacheMu.Unlock()
+	if cache != nil && cache.head == newest {
+		return cache, nil
+	}
+
+	h, listBlockData, err := e.listConfig(headers)
+	if err != nil {
+		return nil, err
+	}
+	listBlock, err := decodeListBlock(listBlockData, h.flags)
+	if err != nil {
+		return nil, err
+	}
+	idx := newIndex(h, listBlock)
+	e.setCache(idx)
+	return idx, nil
 }
 
-func (e *Bucket) getNewListNotContainKey(
-	listBlockData []byte,
-	key []byte,
-	isReturnListInfo bool,
-) (newListBlockData []byte, newListBlockInfo []block) {
-	sizeKey := uint(len(key))
-	var sumKey uint
-	for i := 0; i < len(key); i++ {
-		sumKey += uint(key[i])
+func (e *Bucket) setCache(idx *index) {
+	e.cacheMu.Lock()
+	e.cache = idx
+	e.cacheMu.Unlock()
+}
+
+// writeAt queues a write for the commit in progress.
+func (e *Bucket) writeAt(data []byte, off uint) int {
+	e.pending = append(e.pending, walWrite{off: int64(off), data: slices.Clone(data)})
+	return len(data)
+}
+
+func (e *Bucket) readHeaderRegion() ([]byte, error) {
+	buffer := make([]byte, cFirstSize)
+	if _, err := e.reader.ReadAt(buffer, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
 	}
-	var sumMd5 uint
-	keyMd5 := e.md5(key)
-	for i := 0; i < len(keyMd5); i++ {
-		sumMd5 += uint(keyMd5[i])
+	return buffer, nil
+}
+
+// getListConfig returns the newest header whose list can be read, together
+// with that list.
+func (e *Bucket) getListConfig() (header, []byte, error) {
+	buffer, err := e.readHeaderRegion()
+	if err != nil {
+		return header{}, nil, err
+	}
+	return e.listConfig(decodeHeaders(buffer))
+}
+
+func (e *Bucket) listConfig(headers []header) (header, []byte, error) {
+	if len(headers) == 0 {
+		return e.emptyHeader(), []byte{}, nil
+	}
+	var err error
+	for i := 0; i < len(headers); i++ {
+		var listBlockData []byte
+		if listBlockData, err = e.readList(headers[i]); err == nil {
+			return headers[i], listBlockData, nil
+		}
+	}
+	return header{}, nil, err
+}
+
+func (e *Bucket) readList(h header) ([]byte, error) {
+	listBlockData := make([]byte, h.size)
+	if _, err := e.reader.ReadAt(listBlockData, int64(h.start)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: list at %d is truncated", ErrCorrupt, h.start)
+		}
+		return nil, err
+	}
+	if h.legacy {
+		idx := slices.Index(listBlockData, cEnd)
+		if idx > -1 {
+			listBlockData = listBlockData[:idx]
+		}
+	} else if crc32.ChecksumIEEE(listBlockData) != h.listCrc {
+		return nil, fmt.Errorf("%w: list at %d does not match its checksum", ErrCorrupt, h.start)
 	}
+	return listBlockData, nil
+}
 
+// decodeListBlock parses the index list into its block records, using the
+// encoding given by the header flags.
+func decodeListBlock(listBlockData []byte, flags uint32) ([]block, error) {
+	if flags&flagVarintIndex != 0 {
+		return decodeVarintList(listBlockData)
+	}
+	var listBlock []block
 	blockInfo := emptyBlock
 	var tmpGroup []byte
 	for i := 0; i < len(listBlockData); i++ {
 		v := listBlockData[i]
 		switch v {
 		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
+			blockInfo.start = digitsToNumber(tmpGroup)
+			tmpGroup = tmpGroup[:0]
 		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
+			blockInfo.sizeKey = digitsToNumber(tmpGroup)
+			tmpGroup = tmpGroup[:0]
 		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
+			blockInfo.sumKey = digitsToNumber(tmpGroup)
+			tmpGroup = tmpGroup[:0]
 		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
+			blockInfo.sumMd5 = digitsToNumber(tmpGroup)
+			tmpGroup = tmpGroup[:0]
 		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-			if blockInfo.sizeKey == sizeKey && blockInfo.sumKey == sumKey &&
-				blockInfo.sumMd5 == sumMd5 {
-				foundKey := e.pullKey(blockInfo)
-				if bytes.Equal(foundKey, key) {
-					continue
-				}
-			}
-			newListBlockData = pushBlockToData(newListBlockData, &blockInfo)
-			if isReturnListInfo {
-				newListBlockInfo = append(newListBlockInfo, blockInfo)
-			}
+			blockInfo.sizeData = digitsToNumber(tmpGroup)
+			tmpGroup = tmpGroup[:0]
+			listBlock = append(listBlock, blockInfo)
 			blockInfo = emptyBlock
 		case cEnd:
-			break
+			return listBlock, nil
 		default:
 			tmpGroup = append(tmpGroup, v)
 		}
 	}
-	return newListBlockData, newListBlockInfo
+	if len(tmpGroup) > 0 {
+		return listBlock, fmt.Errorf("%w: unterminated record in index list", ErrCorrupt)
+	}
+	return listBlock, nil
+}
+
+func encodeListBlock(listBlock []block, flags uint32) []byte {
+	var listBlockData []byte
+	for i := 0; i < len(listBlock); i++ {
+		if flags&flagVarintIndex != 0 {
+			listBlockData = pushBlockToVarint(listBlockData, &listBlock[i])
+		} else {
+			listBlockData = pushBlockToData(listBlockData, &listBlock[i])
+		}
+	}
+	return listBlockData
+}
+
+// keyInfo returns the fingerprint (sizeKey, sumKey, sumMd5) stored for key.
+//
+// With flagHash64 the 64-bit FNV-1a hash of the key is split over sumKey (high
+// half) and sumMd5 (low half). Older lists store the byte sum of the key and
+// the digit sum of its hex MD5 instead, which collide easily.
+func (e *Bucket) keyInfo(key []byte, flags uint32) block {
+	if flags&flagHash64 != 0 {
+		hash := fnv.New64a()
+		hash.Write(key)
+		sum := hash.Sum64()
+		return block{
+			sizeKey: uint(len(key)),
+			sumKey:  uint(sum >> 32),
+			sumMd5:  uint(sum & 0xffffffff),
+		}
+	}
+	var sumKey uint
+	for i := 0; i < len(key); i++ {
+		sumKey += uint(key[i])
+	}
+	var sumMd5 uint
+	keyMd5 := e.md5(key)
+	for i := 0; i < len(keyMd5); i++ {
+		sumMd5 += uint(keyMd5[i])
+	}
+	return block{
+		sizeKey: uint(len(key)),
+		sumKey:  sumKey,
+		sumMd5:  sumMd5,
+	}
+}
+
+// keyPositions returns the positions in idx of the blocks storing key.
+func (e *Bucket) keyPositions(idx *index, key []byte) ([]int, error) {
+	var positions []int
+	candidates := idx.position[e.keyInfo(key, idx.head.flags).keyHash()]
+	for _, i := range candidates {
+		if idx.listBlock[i].dead {
+			continue
+		}
+		foundKey, err := e.pullKey(idx.listBlock[i])
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(foundKey, key) {
+			positions = append(positions, i)
+		}
+	}
+	return positions, nil
+}
+
+// findKey returns the position of key in idx, or -1 when it is not stored.
+func (e *Bucket) findKey(idx *index, key []byte) (int, error) {
+	positions, err := e.keyPositions(idx, key)
+	if err != nil || len(positions) == 0 {
+		return -1, err
+	}
+	return positions[0], nil
+}
+
+func (e *Bucket) setOneData(idx *index, item Item) (int, error) {
+	return e.setDelayedData(idx, item, 0)
+}
+
+// setDelayedData is like setOneData but hides the item from List and the
+// consumers until the unix time notBefore, in nanoseconds.
+func (e *Bucket) setDelayedData(idx *index, item Item, notBefore uint64) (int, error) {
+	if err := checkPriority(idx.head, item); err != nil {
+		return 0, err
+	}
+	newListBlock, err := e.getNewListNotContainListKey(idx, []Item{{Key: item.Key}})
+	if err != nil {
+		return 0, err
+	}
+	space := e.newSpaceAllocator(idx.listBlock)
+	info := e.keyInfo(item.Key, idx.head.flags)
+	info.sizeData = uint(len(item.Data))
+	info.version = nextVersion(idx.head)
+	info.notBefore = notBefore
+	info.priority = int64(item.Priority)
+	info.start = space.alloc(info.sizeKey + info.sizeData)
+	e.updateListBlock(space, append(newListBlock, info))
+	return e.writeAt(append(slices.Clip(item.Key), item.Data...), info.start), nil
+}
+
+// replaceData stores data as the new value of the block at pos. Unlike
+// setOneData, the item keeps its place in the list and its metadata: priority,
+// schedule, lease and delivery count. Only its version changes.
+func (e *Bucket) replaceData(idx *index, pos int, data []byte) (int, error) {
+	info := idx.listBlock[pos]
+	key, err := e.pullKey(info)
+	if err != nil {
+		return 0, err
+	}
+	// Files of older versions may store a key more than once; pos is the
+	// copy reads return, drop the others.
+	positions, err := e.keyPositions(idx, key)
+	if err != nil {
+		return 0, err
+	}
+	space := e.newSpaceAllocator(idx.listBlock)
+	info.sizeData = uint(len(data))
+	info.version = nextVersion(idx.head)
+	info.start = space.alloc(info.sizeKey + info.sizeData)
+	listBlock := make([]block, 0, len(idx.listBlock))
+	for i := 0; i < len(idx.listBlock); i++ {
+		switch {
+		case i == pos:
+			listBlock = append(listBlock, info)
+		case !slices.Contains(positions, i):
+			listBlock = append(listBlock, idx.listBlock[i])
+		}
+	}
+	e.updateListBlock(space, listBlock)
+	return e.writeAt(append(key, data...), info.start), nil
+}
+
+// checkPriority returns ErrNeedsMigration when one of items has a priority
+// that the list committed by h cannot store.
+func checkPriority(h header, items ...Item) error {
+	if storesMetadata(h) {
+		return nil
+	}
+	for i := 0; i < len(items); i++ {
+		if items[i].Priority != 0 {
+			return ErrNeedsMigration
+		}
+	}
+	return nil
+}
+
+func (e *Bucket) md5(input []byte) []byte {
+	hash := md5.New()
+	hash.Write(input)
+	return []byte(hex.EncodeToString(hash.Sum(nil)))
 }
 
 func groupDigitsAppend(dst *[]byte, n uint) {
@@ -362,782 +1209,682 @@ func pushBlockToData(buf []byte, b *block) []byte {
 	return buf
 }
 
-func (e *Bucket) pullKey(info block) []byte {
+// pushBlockToVarint appends the record of b used by flagVarintIndex lists: a
+// uvarint record length followed by
+//
+//	start uvarint | sizeKey uvarint | sizeData uvarint | key hash u64 | attributes
+//
+// Attributes hold the optional metadata of the block, each as a uvarint tag
+// and a uvarint value. Only attributes with a value other than 0 are written,
+// and readers skip tags they do not know.
+func pushBlockToVarint(buf []byte, b *block) []byte {
+	var record [3*binary.MaxVarintLen64 + 8 + attrMaxSize]byte
+	n := binary.PutUvarint(record[:], uint64(b.start))
+	n += binary.PutUvarint(record[n:], uint64(b.sizeKey))
+	n += binary.PutUvarint(record[n:], uint64(b.sizeData))
+	binary.LittleEndian.PutUint64(record[n:], uint64(b.sumKey)<<32|uint64(b.sumMd5))
+	n += 8
+	for _, a := range b.attributes() {
+		if a.value != 0 {
+			n += binary.PutUvarint(record[n:], a.tag)
+			n += binary.PutUvarint(record[n:], a.value)
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(n))
+	return append(buf, record[:n]...)
+}
+
+// Attribute tags of varint records.
+const (
+	attrVersion uint64 = 1 + iota
+	attrLeaseUntil
+	attrLeaseID
+	attrDeliveries
+	attrDead
+	attrNotBefore
+	attrPriority
+)
+
+// attrCount is the number of attribute tags, attrMaxSize the most bytes the
+// attributes of one record take.
+const (
+	attrCount   = 7
+	attrMaxSize = attrCount * 2 * binary.MaxVarintLen64
+)
+
+type attribute struct {
+	tag   uint64
+	value uint64
+}
+
+func (b *block) attributes() [attrCount]attribute {
+	return [...]attribute{
+		{attrVersion, b.version},
+		{attrLeaseUntil, b.leaseUntil},
+		{attrLeaseID, b.leaseID},
+		{attrDeliveries, b.deliveries},
+		{attrDead, boolAttribute(b.dead)},
+		{attrNotBefore, b.notBefore},
+		{attrPriority, uint64(b.priority)},
+	}
+}
+
+func (b *block) setAttribute(tag uint64, value uint64) {
+	switch tag {
+	case attrVersion:
+		b.version = value
+	case attrLeaseUntil:
+		b.leaseUntil = value
+	case attrLeaseID:
+		b.leaseID = value
+	case attrDeliveries:
+		b.deliveries = value
+	case attrDead:
+		b.dead = value != 0
+	case attrNotBefore:
+		b.notBefore = value
+	case attrPriority:
+		b.priority = int64(value)
+	}
+}
+
+func boolAttribute(v bool) uint64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// storesMetadata reports whether the list of h can store the versions, leases,
+// schedules and priorities of its blocks, i.e. whether the file is in format 2.
+func storesMetadata(h header) bool {
+	return h.flags&flagVarintIndex != 0
+}
+
+// nextVersion returns the version of the blocks written by the commit after
+// h, or 0 when its list cannot store versions.
+func nextVersion(h header) uint64 {
+	if !storesMetadata(h) {
+		return 0
+	}
+	return h.seq + 1
+}
+
+func decodeVarintList(listBlockData []byte) ([]block, error) {
+	var listBlock []block
+	for len(listBlockData) > 0 {
+		size, n := binary.Uvarint(listBlockData)
+		if n <= 0 || uint64(len(listBlockData)-n) < size {
+			return listBlock, fmt.Errorf("%w: unterminated record in index list", ErrCorrupt)
+		}
+		record := listBlockData[n : n+int(size)]
+		listBlockData = listBlockData[n+int(size):]
+
+		var blockInfo block
+		var fields [3]uint64
+		for i := range fields {
+			v, n := binary.Uvarint(record)
+			if n <= 0 {
+				return listBlock, fmt.Errorf("%w: bad record in index list", ErrCorrupt)
+			}
+			fields[i] = v
+			record = record[n:]
+		}
+		if len(record) < 8 {
+			return listBlock, fmt.Errorf("%w: bad record in index list", ErrCorrupt)
+		}
+		hash := binary.LittleEndian.Uint64(record)
+		for record = record[8:]; len(record) > 0; {
+			tag, n := binary.Uvarint(record)
+			if n <= 0 {
+				return listBlock, fmt.Errorf("%w: bad record in index list", ErrCorrupt)
+			}
+			value, m := binary.Uvarint(record[n:])
+			if m <= 0 {
+				return listBlock, fmt.Errorf("%w: bad record in index list", ErrCorrupt)
+			}
+			blockInfo.setAttribute(tag, value)
+			record = record[n+m:]
+		}
+		blockInfo.start = uint(fields[0])
+		blockInfo.sizeKey = uint(fields[1])
+		blockInfo.sizeData = uint(fields[2])
+		blockInfo.sumKey = uint(hash >> 32)
+		blockInfo.sumMd5 = uint(hash & 0xffffffff)
+		listBlock = append(listBlock, blockInfo)
+	}
+	return listBlock, nil
+}
+
+func (e *Bucket) pullKey(info block) ([]byte, error) {
 	foundKey := make([]byte, info.sizeKey)
-	_, _ = e.reader.ReadAt(foundKey, int64(info.start))
-	return foundKey
+	if _, err := e.reader.ReadAt(foundKey, int64(info.start)); err != nil {
+		return nil, blockReadError(err, info)
+	}
+	return foundKey, nil
 }
 
-func (e *Bucket) getListSpace(startListPoint uint, listBlockInfo []block) []block {
-	var listStartBlock []uint
-	mapStartBlock := map[uint]uint{}
-	for i := 0; i < len(listBlockInfo); i++ {
-		b := listBlockInfo[i]
-		listStartBlock = append(listStartBlock, b.start)
-		mapStartBlock[b.start] = b.sizeKey + b.sizeData
+func blockReadError(err error, info block) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: block at %d is past the end of file", ErrCorrupt, info.start)
 	}
-	sort.Slice(listStartBlock, func(i, j int) bool {
-		return listStartBlock[i] < listStartBlock[j]
+	return err
+}
+
+// spaceAllocator hands out free file ranges for a commit. Ranges used by the
+// committed index, its blocks and its list, are never handed out, so the header
+// slot of the previous commit stays readable until the next commit replaces it.
+// While views are open no free range is handed out at all, see View.
+type spaceAllocator struct {
+	listSpace []block
+	end       uint
+}
+
+func (e *Bucket) newSpaceAllocator(listBlock []block) *spaceAllocator {
+	used := appendUsed(make([]block, 0, len(listBlock)+1), e.head, listBlock)
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].start < used[j].start
 	})
-	currentPoint := cFirstSize
-	var listSpace []block
-	for i := 0; i < len(listStartBlock); i++ {
-		start := listStartBlock[i]
-		if currentPoint < start {
-			listSpace = append(listSpace, block{
-				start:    currentPoint,
-				sizeKey:  0,
-				sumKey:   0,
-				sumMd5:   0,
-				sizeData: start - currentPoint,
+	space := &spaceAllocator{end: cFirstSize}
+	for i := 0; i < len(used); i++ {
+		u := used[i]
+		if space.end < u.start {
+			space.listSpace = append(space.listSpace, block{
+				start:    space.end,
+				sizeData: u.start - space.end,
 			})
 		}
-		currentPoint = start + mapStartBlock[start]
+		space.end = max(space.end, u.start+u.sizeData)
 	}
-	lastSpaceSize := startListPoint - currentPoint
-	if lastSpaceSize > 0 {
-		listSpace = append(listSpace, block{
-			start:    currentPoint,
-			sizeKey:  0,
-			sumKey:   1, // space này là vị trí còn trống cuối cùng trước list
-			sumMd5:   0,
-			sizeData: lastSpaceSize,
-		})
-	}
-	return listSpace
-}
-
-func (e *Bucket) getPerfectSpace(
-	listSpace []block,
-	startListPoint uint,
-	blockSize uint,
-) (uint, uint) {
-	perfectBlockSize := blockSize
-	var perfectFreeSize uint
-	startBlock := startListPoint
-	var isLastSpace bool
-	for i := 0; i < len(listSpace); i++ {
-		s := listSpace[i]
-		if s.sizeData >= blockSize || s.sumKey == 1 {
-			newSize := s.sizeData
-			if newSize > perfectFreeSize ||
-				(perfectFreeSize > newSize && startListPoint > s.start+s.sizeData) {
-				perfectFreeSize = newSize
-				startBlock = s.start
-				isLastSpace = s.sumKey == 1
-			}
+	if e.viewsActive() {
+		// Open views may still read any block of the file: only grow it.
+		space.listSpace = nil
+		if info, err := e.writer.Stat(); err == nil {
+			space.end = max(space.end, uint(info.Size()))
 		}
 	}
-	if perfectFreeSize >= perfectBlockSize {
-		perfectBlockSize = 0
+	return space
+}
+
+// appendUsed appends the file ranges used by the blocks of listBlock and by
+// the list committed by h.
+func appendUsed(used []block, h header, listBlock []block) []block {
+	for i := 0; i < len(listBlock); i++ {
+		b := listBlock[i]
+		used = append(used, block{start: b.start, sizeData: b.sizeKey + b.sizeData})
 	}
-	var startList uint
-	if isLastSpace {
-		startList = startBlock + blockSize
-	} else {
-		startList = startListPoint + perfectBlockSize
+	if (h.seq > 0 || h.legacy) && h.start >= cFirstSize {
+		used = append(used, block{start: h.start, sizeData: h.listEnd() - h.start})
 	}
-	return startList, startBlock
+	return used
 }
 
-func (e *Bucket) updateListBlock(start uint, listBlockData []byte) (n int, err error) {
-	var firstBlockData []byte
-	groupDigitsAppend(&firstBlockData, start)
-	firstBlockData = append(firstBlockData, cEnd)
-	groupDigitsAppend(&firstBlockData, uint(len(listBlockData)))
-	firstBlockData = append(firstBlockData, cEnd)
+// alloc returns the start of a free range of size bytes, using the smallest
+// gap it fits in and growing the file otherwise.
+func (s *spaceAllocator) alloc(size uint) uint {
+	if start, ok := s.allocBefore(size, s.end); ok {
+		return start
+	}
+	return s.grow(size)
+}
 
-	n, err = e.writer.WriteAt(append(listBlockData, cEnd), int64(start))
-	if err != nil {
-		return n, err
+// grow returns the start of size bytes added at the end of the file.
+func (s *spaceAllocator) grow(size uint) uint {
+	start := s.end
+	s.end += size
+	return start
+}
+
+// take hands out the range of size bytes at start, and reports false when it
+// is not free.
+func (s *spaceAllocator) take(start uint, size uint) bool {
+	for i, gap := range s.listSpace {
+		if gap.start <= start && start+size <= gap.start+gap.sizeData {
+			s.listSpace[i].sizeData = start - gap.start
+			s.listSpace = append(s.listSpace, block{
+				start:    start + size,
+				sizeData: gap.start + gap.sizeData - start - size,
+			})
+			return true
+		}
 	}
-	n, err = e.writer.WriteAt(firstBlockData, 0)
-	return n, err
+	return false
+}
+
+// allocBefore is like alloc but only uses gaps starting before limit. It
+// reports false when none fits.
+func (s *spaceAllocator) allocBefore(size uint, limit uint) (uint, bool) {
+	perfect := -1
+	for i := 0; i < len(s.listSpace) && size > 0; i++ {
+		if s.listSpace[i].start < limit && s.listSpace[i].sizeData >= size &&
+			(perfect < 0 || s.listSpace[i].sizeData < s.listSpace[perfect].sizeData) {
+			perfect = i
+		}
+	}
+	if perfect < 0 {
+		return 0, false
+	}
+	start := s.listSpace[perfect].start
+	s.listSpace[perfect].start += size
+	s.listSpace[perfect].sizeData -= size
+	return start, true
+}
+
+// updateListBlock queues the new list and the header slot that commits it.
+func (e *Bucket) updateListBlock(space *spaceAllocator, listBlock []block) int {
+	listBlockData := encodeListBlock(listBlock, e.head.flags)
+	h := header{
+		seq:     e.head.seq + 1,
+		start:   space.alloc(uint(len(listBlockData)) + 1),
+		size:    uint(len(listBlockData)),
+		flags:   e.head.flags,
+		listCrc: crc32.ChecksumIEEE(listBlockData),
+	}
+	e.next = newIndex(h, listBlock)
+	e.writeAt(append(listBlockData, cEnd), h.start)
+	return e.writeAt(encodeSlot(h), slotOffset(h.seq))
 }
 
 // Get returns the stored key and value for the provided key.
 //
-// If the key does not exist, implementations typically return nil, nil (or empty slices).
-// Document the exact “not found” behavior here if it differs.
+// If the key does not exist, or the file cannot be read, Get returns nil, nil.
+// Use GetE to tell these cases apart.
 func (e *Bucket) Get(key []byte) ([]byte, []byte) {
-	_, listBlockData := e.getListConfig()
-	return e.getOneData(listBlockData, key)
+	item, err := e.get(key)
+	if err != nil {
+		return nil, nil
+	}
+	return item.Key, item.Data
 }
 
-func (e *Bucket) getOneData(listBlockData []byte, key []byte) (rsKey []byte, rsData []byte) {
-	sizeKey := uint(len(key))
-	var sumKey uint
-	for i := 0; i < len(key); i++ {
-		sumKey += uint(key[i])
-	}
-	var sumMd5 uint
-	keyMd5 := e.md5(key)
-	for i := 0; i < len(keyMd5); i++ {
-		sumMd5 += uint(keyMd5[i])
+// GetE returns the value stored for key.
+//
+// It returns ErrNotFound if the key does not exist, and any other error if the
+// index or the block could not be read.
+func (e *Bucket) GetE(key []byte) ([]byte, error) {
+	item, err := e.get(key)
+	if err != nil {
+		return nil, err
 	}
-	blockInfo := emptyBlock
-	var tmpGroup []byte
-	for i := 0; i < len(listBlockData); i++ {
-		v := listBlockData[i]
-		switch v {
-		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-			if blockInfo.sizeKey == sizeKey && blockInfo.sumKey == sumKey &&
-				blockInfo.sumMd5 == sumMd5 {
-				foundKey, foundData := e.pullData(blockInfo)
-				if bytes.Equal(foundKey, key) {
-					rsKey = foundKey
-					rsData = foundData
-					break
-				}
-			}
-			blockInfo = emptyBlock
-		case cEnd:
-			break
-		default:
-			tmpGroup = append(tmpGroup, v)
+	return item.Data, nil
+}
+
+// GetItem returns the item stored for key, with its Version.
+//
+// It returns ErrNotFound if the key does not exist.
+func (e *Bucket) GetItem(key []byte) (Item, error) {
+	return e.get(key)
+}
+
+func (e *Bucket) get(key []byte) (item Item, err error) {
+	err = e.view(context.Background(), func(idx *index) error {
+		item, err = e.getOneData(idx, key)
+		return err
+	})
+	return item, err
+}
+
+func (e *Bucket) getOneData(idx *index, key []byte) (Item, error) {
+	candidates := idx.position[e.keyInfo(key, idx.head.flags).keyHash()]
+	for _, i := range candidates {
+		if idx.listBlock[i].dead {
+			continue
+		}
+		foundKey, foundData, err := e.pullData(idx.listBlock[i])
+		if err != nil {
+			return Item{}, err
+		}
+		if bytes.Equal(foundKey, key) {
+			return idx.listBlock[i].item(foundKey, foundData), nil
 		}
 	}
-	return
+	return Item{}, ErrNotFound
 }
 
-func (e *Bucket) pullData(info block) ([]byte, []byte) {
+func (e *Bucket) pullData(info block) ([]byte, []byte, error) {
 	foundKey := make([]byte, info.sizeKey)
 	foundData := make([]byte, info.sizeData)
-	_, err := e.writer.ReadAt(foundKey, int64(info.start))
+	_, err := e.reader.ReadAt(foundKey, int64(info.start))
 	if err != nil {
-		return nil, nil
+		return nil, nil, blockReadError(err, info)
 	}
-	_, err = e.writer.ReadAt(foundData, int64(info.start+info.sizeKey))
+	_, err = e.reader.ReadAt(foundData, int64(info.start+info.sizeKey))
 	if err != nil {
-		return nil, nil
+		return nil, nil, blockReadError(err, info)
+	}
+	return foundKey, foundData, nil
+}
+
+// pullItem reads the block and reports whether the stored key still matches
+// the fingerprint recorded in the index.
+func (e *Bucket) pullItem(info block, flags uint32) (Item, bool, error) {
+	foundKey, foundData, err := e.pullData(info)
+	if err != nil {
+		return Item{}, false, err
+	}
+	if e.keyInfo(foundKey, flags).keyHash() != info.keyHash() {
+		return Item{}, false, nil
 	}
-	return foundKey, foundData
+	return info.item(foundKey, foundData), true, nil
+}
+
+// item returns the Item stored in the block, with its metadata.
+func (b block) item(key []byte, data []byte) Item {
+	item := Item{
+		Key:        key,
+		Data:       data,
+		Version:    b.version,
+		Deliveries: int(b.deliveries),
+		Priority:   int(b.priority),
+	}
+	if b.notBefore > 0 {
+		item.NotBefore = time.Unix(0, int64(b.notBefore))
+	}
+	return item
 }
 
 // Delete removes an item by key.
 //
 // It returns n (implementation-defined; commonly bytes removed or affected records)
 // and a non-nil error on failure.
-func (e *Bucket) Delete(key []byte) (int, error) {
-	_ = syscall.Flock(int(e.fd), syscall.LOCK_EX)
-	defer syscall.Flock(int(e.fd), syscall.LOCK_UN)
-	e.mu.Lock()
-	defer e.mu.Unlock()
+func (e *Bucket) Delete(key []byte, opts ...WriteOption) (n int, err error) {
+	return e.DeleteCtx(context.Background(), key, opts...)
+}
 
-	startListPoint, listBlockData := e.getListConfig()
-	return e.deleteOneData(
-		listBlockData,
-		key,
-		startListPoint,
-	)
+// DeleteCtx is like Delete but gives up waiting for the file lock when ctx is
+// done, returning ErrLockTimeout.
+func (e *Bucket) DeleteCtx(
+	ctx context.Context,
+	key []byte,
+	opts ...WriteOption,
+) (n int, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		n, err = e.deleteOneData(idx, key)
+		return err
+	})
+	return n, err
 }
 
-func (e *Bucket) deleteOneData(listBlockData []byte, key []byte, startListPoint uint) (int, error) {
-	newListBlockData, _ := e.getNewListNotContainKey(listBlockData, key, false)
-	return e.updateListBlock(startListPoint, newListBlockData)
+func (e *Bucket) deleteOneData(idx *index, key []byte) (int, error) {
+	newListBlock, err := e.getNewListNotContainListKey(idx, []Item{{Key: key}})
+	if err != nil {
+		return 0, err
+	}
+	return e.updateListBlock(e.newSpaceAllocator(idx.listBlock), newListBlock), nil
 }
 
-// SetMany writes multiple items.
+// SetMany writes multiple items. When a key is repeated in listData the last
+// item wins.
 //
-// The return value is the number of successfully written items.
-func (e *Bucket) SetMany(listData []Item) int {
-	_ = syscall.Flock(int(e.fd), syscall.LOCK_EX)
-	defer syscall.Flock(int(e.fd), syscall.LOCK_UN)
-	e.mu.Lock()
-	defer e.mu.Unlock()
-
-	startListPoint, listBlockData := e.getListConfig()
-	return e.setManyData(
-		listBlockData,
-		listData,
-		startListPoint,
-	)
+// The return value is the number of successfully written items, counting a
+// repeated key once.
+func (e *Bucket) SetMany(listData []Item, opts ...WriteOption) (count int) {
+	count, _ = e.SetManyCtx(context.Background(), listData, opts...)
+	return count
 }
 
-func (e *Bucket) setManyData(
-	listBlockData []byte,
+// SetManyCtx is like SetMany but reports errors, and gives up waiting for the
+// file lock when ctx is done, returning ErrLockTimeout. When an error is
+// returned no item has been written.
+func (e *Bucket) SetManyCtx(
+	ctx context.Context,
 	listData []Item,
-	startListPoint uint,
-) (count int) {
-	newListBlockData, newListBlockInfo := e.getNewListNotContainListKey(
-		listBlockData,
-		&listData,
-		true,
-	)
-
-	var listBlockInsertPosition []string
-	var minSizeBlock uint
-	var listConfigInsert []block
-
-	var maxSizeBlock uint
-	for i := 0; i < len(listData); i++ {
-		item := listData[i]
-		key := item.Key
-		data := item.Data
-		sizeKey := uint(len(key))
-		sizeData := uint(len(data))
-		blockSize := sizeKey + sizeData
-		if minSizeBlock == 0 || blockSize < minSizeBlock {
-			minSizeBlock = blockSize
-		}
-		if blockSize > maxSizeBlock {
-			maxSizeBlock = blockSize
-		}
-		var sumKey uint
-		for i := 0; i < len(key); i++ {
-			sumKey += uint(key[i])
-		}
-		var sumMd5 uint
-		keyMd5 := e.md5(key)
-		for i := 0; i < len(keyMd5); i++ {
-			sumMd5 += uint(keyMd5[i])
-		}
-		listConfigInsert = append(listConfigInsert, block{
-			start:    uint(i),
-			sizeKey:  sizeKey,
-			sumKey:   sumKey,
-			sumMd5:   sumMd5,
-			sizeData: sizeData,
-		})
-		listBlockInsertPosition = append(
-			listBlockInsertPosition,
-			fmt.Sprintf("%d%d%d%d", sizeKey, sumKey, sumMd5, sizeData),
-		)
-	}
-
-	sort.Slice(listConfigInsert, func(i, j int) bool {
-		itemA := listConfigInsert[i]
-		itemB := listConfigInsert[j]
-		ka := itemA.sizeKey + itemA.sizeData
-		kb := itemB.sizeKey + itemB.sizeData
-		return ka > kb
+	opts ...WriteOption,
+) (count int, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		count, err = e.setManyData(idx, listData)
+		return err
 	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
 
-	startListBlock := startListPoint
-	var listInfoData []byte
-	selected := map[uint]bool{}
-	type writeDataTemp struct {
-		start uint
-		key   []byte
-		data  []byte
-	}
-	var listWriteData []writeDataTemp
-	var totalLastSpaceUsed uint
-	mapBlockInsert := map[string]block{}
-	listSpace := e.getListSpace(startListPoint, newListBlockInfo)
-	for i := 0; i < len(listSpace); i++ {
-		s := listSpace[i]
-		var thisSpaceUsed uint
-		if s.sizeData < minSizeBlock && s.sumKey == 0 {
-			continue
-		}
-		for j := 0; j < len(listConfigInsert); j++ {
-			c := listConfigInsert[j]
-			if selected[c.start] {
-				continue
-			}
-			blockSize := c.sizeKey + c.sizeData
-			if s.sizeData >= blockSize+thisSpaceUsed || s.sumKey == 1 {
-				selected[c.start] = true
-
-				startBlock := s.start + thisSpaceUsed
-				item := listData[c.start]
-				key := item.Key
-				data := item.Data
-				e.addToMapSort(&mapBlockInsert, c, startBlock)
-				listWriteData = append(listWriteData, writeDataTemp{
-					start: startBlock,
-					key:   key,
-					data:  data,
-				})
-				thisSpaceUsed += blockSize
-			}
-			if s.sumKey == 1 {
-				startListBlock = s.start
-				totalLastSpaceUsed += blockSize
-			}
-		}
+func (e *Bucket) setManyData(idx *index, listData []Item) (int, error) {
+	if err := checkPriority(idx.head, listData...); err != nil {
+		return 0, err
 	}
+	newListBlock, err := e.getNewListNotContainListKey(idx, listData)
+	if err != nil {
+		return 0, err
+	}
+	return e.appendItems(idx, newListBlock, listData), nil
+}
 
-	for i := 0; i < len(listConfigInsert); i++ {
-		c := listConfigInsert[i]
-		if selected[c.start] {
+// appendItems queues the blocks of listData and the list made of newListBlock
+// followed by them, and returns the number of items written.
+func (e *Bucket) appendItems(idx *index, newListBlock []block, listData []Item) int {
+	// When a key is repeated in listData the last item wins.
+	lastIndex := map[string]int{}
+	for i := 0; i < len(listData); i++ {
+		lastIndex[string(listData[i].Key)] = i
+	}
+	var listInsert []int
+	listConfigInsert := make([]block, len(listData))
+	for i := 0; i < len(listData); i++ {
+		item := listData[i]
+		if lastIndex[string(item.Key)] != i {
 			continue
 		}
-		selected[c.start] = true
-		blockSize := c.sizeKey + c.sizeData
-		startBlock := startListBlock + totalLastSpaceUsed
-		item := listData[c.start]
-		key := item.Key
-		data := item.Data
-		e.addToMapSort(&mapBlockInsert, c, startBlock)
-		listWriteData = append(listWriteData, writeDataTemp{
-			start: startBlock,
-			key:   key,
-			data:  data,
-		})
-		totalLastSpaceUsed += blockSize
+		info := e.keyInfo(item.Key, idx.head.flags)
+		info.sizeData = uint(len(item.Data))
+		info.version = nextVersion(idx.head)
+		info.priority = int64(item.Priority)
+		listConfigInsert[i] = info
+		listInsert = append(listInsert, i)
 	}
 
-	for i := 0; i < len(listBlockInsertPosition); i++ {
-		blockData := mapBlockInsert[listBlockInsertPosition[i]]
-		infoData := pushBlockToData([]byte{}, &blockData)
-		listInfoData = append(listInfoData, infoData...)
+	// Place the largest blocks first, they are the hardest to fit in a gap.
+	listBySize := slices.Clone(listInsert)
+	sort.SliceStable(listBySize, func(i, j int) bool {
+		itemA := listConfigInsert[listBySize[i]]
+		itemB := listConfigInsert[listBySize[j]]
+		return itemA.sizeKey+itemA.sizeData > itemB.sizeKey+itemB.sizeData
+	})
+	space := e.newSpaceAllocator(idx.listBlock)
+	for _, i := range listBySize {
+		c := &listConfigInsert[i]
+		c.start = space.alloc(c.sizeKey + c.sizeData)
 	}
 
-	_, err := e.updateListBlock(startListBlock+totalLastSpaceUsed, append(
-		newListBlockData, listInfoData...))
-	if err != nil {
-		return
+	for _, i := range listInsert {
+		newListBlock = append(newListBlock, listConfigInsert[i])
 	}
-	for i := 0; i < len(listWriteData); i++ {
-		item := listWriteData[i]
-		if _, err = e.writer.WriteAt(append(item.key, item.data...), int64(item.start)); err == nil {
-			count++
-		}
+	e.updateListBlock(space, newListBlock)
+	for _, i := range listInsert {
+		item := listData[i]
+		e.writeAt(append(slices.Clip(item.Key), item.Data...), listConfigInsert[i].start)
 	}
-	return
+	return len(listInsert)
 }
 
-func (e *Bucket) getNewListNotContainListKey(
-	listBlockData []byte,
-	listData *[]Item,
-	isReturnListInfo bool,
-) (newListBlockData []byte, newListBlockInfo []block) {
-	listSkipCheck := map[string]bool{}
-	blockInfo := emptyBlock
-	var tmpGroup []byte
-	for i := 0; i < len(listBlockData); i++ {
-		v := listBlockData[i]
-		switch v {
-		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-
-			isFoundKey := false
-			for i := 0; i < len(*listData); i++ {
-				curKey := (*listData)[i]
-				curKeyMd5 := string(e.md5(curKey.Key))
-				if listSkipCheck[curKeyMd5] {
-					continue
-				}
-				key := curKey.Key
-				sizeKey := uint(len(key))
-				var sumKey uint
-				for i := 0; i < len(key); i++ {
-					sumKey += uint(key[i])
-				}
-				var sumMd5 uint
-				keyMd5 := e.md5(key)
-				for i := 0; i < len(keyMd5); i++ {
-					sumMd5 += uint(keyMd5[i])
-				}
-
-				if blockInfo.sizeKey == sizeKey && blockInfo.sumKey == sumKey &&
-					blockInfo.sumMd5 == sumMd5 {
-					foundKey := e.pullKey(blockInfo)
-					if bytes.Equal(foundKey, key) {
-						// success
-						isFoundKey = true
-						listSkipCheck[curKeyMd5] = true
-						break
-					}
-				}
-			}
-			if isFoundKey {
-				continue
-			}
-			newListBlockData = pushBlockToData(newListBlockData, &blockInfo)
-			if isReturnListInfo {
-				newListBlockInfo = append(newListBlockInfo, blockInfo)
-			}
-
-			blockInfo = emptyBlock
-		case cEnd:
-			break
-		default:
-			tmpGroup = append(tmpGroup, v)
+// getNewListNotContainListKey returns a copy of the index list without the
+// blocks of the keys in listData.
+func (e *Bucket) getNewListNotContainListKey(idx *index, listData []Item) ([]block, error) {
+	drop := map[int]bool{}
+	for i := 0; i < len(listData); i++ {
+		positions, err := e.keyPositions(idx, listData[i].Key)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range positions {
+			drop[p] = true
 		}
 	}
-	return nil, nil
+	newListBlock := make([]block, 0, len(idx.listBlock)-len(drop)+len(listData))
+	for i := 0; i < len(idx.listBlock); i++ {
+		if !drop[i] {
+			newListBlock = append(newListBlock, idx.listBlock[i])
+		}
+	}
+	return newListBlock, nil
 }
 
 // List returns up to limit items from the beginning of the bucket (oldest-first by storage order).
+//
+// Read errors are reported as an empty result; use ListE to see them.
 func (e *Bucket) List(limit uint8) []Item {
-	_, listBlockData := e.getListConfig()
-	return e.getListData(listBlockData, limit)
-}
-
-func (e *Bucket) getListData(listBlockData []byte, limit uint8) []Item {
-	var result []Item
-	blockInfo := emptyBlock
-	var tmpGroup []byte
-	var current uint8 = 0
-	for i := 0; i < len(listBlockData); i++ {
-		if current >= limit {
-			break
-		}
-		v := listBlockData[i]
-		switch v {
-		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-
-			foundKey, foundData := e.pullData(blockInfo)
-			sizeFoundKey := uint(len(foundKey))
-			if sizeFoundKey == blockInfo.sizeKey {
-				var sumFoundKey uint
-				for i := 0; i < len(foundKey); i++ {
-					sumFoundKey += uint(foundKey[i])
-				}
-
-				if sumFoundKey == blockInfo.sumKey {
-					var sumFoundMd5 uint
-					keyMd5 := e.md5(foundKey)
-					for i := 0; i < len(keyMd5); i++ {
-						sumFoundMd5 += uint(keyMd5[i])
-					}
-					if sumFoundMd5 == blockInfo.sumMd5 {
-						// success
-						result = append(result, Item{
-							Key:  foundKey,
-							Data: foundData,
-						})
-						current += 1
-					}
-				}
-			}
-
-			blockInfo = emptyBlock
-		case cEnd:
-			break
-		default:
-			tmpGroup = append(tmpGroup, v)
-		}
-	}
+	result, _ := e.ListE(limit)
 	return result
 }
 
-func (e *Bucket) addToMapSort(mapBlockInsert *map[string]block, c block, startBlock uint) {
-	(*mapBlockInsert)[fmt.Sprintf("%d%d%d%d", c.sizeKey, c.sumKey, c.sumMd5, c.sizeData)] = block{
-		start:    startBlock,
-		sizeKey:  c.sizeKey,
-		sumKey:   c.sumKey,
-		sumMd5:   c.sumMd5,
-		sizeData: c.sizeData,
-	}
+// ListE is like List but reports errors reading the index or the blocks.
+func (e *Bucket) ListE(limit uint8) ([]Item, error) {
+	return e.ListNextE(limit, 0)
 }
 
 // ListNext returns up to limit items after skipping skip items.
+//
+// Read errors are reported as an empty result; use ListNextE to see them.
 func (e *Bucket) ListNext(limit uint8, skip uint) []Item {
-	_, listBlockData := e.getListConfig()
-	return e.getListNextData(listBlockData, limit, skip)
+	result, _ := e.ListNextE(limit, skip)
+	return result
 }
 
-func (e *Bucket) getListNextData(listBlockData []byte, limit uint8, skip uint) []Item {
+// ListNextE is like ListNext but reports errors reading the index or the blocks.
+func (e *Bucket) ListNextE(limit uint8, skip uint) (result []Item, err error) {
+	err = e.view(context.Background(), func(idx *index) error {
+		result, err = e.getListNextData(idx, limit, skip)
+		return err
+	})
+	return result, err
+}
+
+func (e *Bucket) getListNextData(idx *index, limit uint8, skip uint) ([]Item, error) {
+	now := time.Now()
+	listBlock := idx.listBlock
 	var result []Item
-	blockInfo := emptyBlock
-	var tmpGroup []byte
 	var current uint8 = 0
 	var currentSkip uint = 0
-	for i := 0; i < len(listBlockData); i++ {
-		if current >= limit {
-			break
+	for i := 0; i < len(listBlock) && current < limit; i++ {
+		if listBlock[i].dead || !listBlock[i].due(now) {
+			continue
 		}
-		v := listBlockData[i]
-		switch v {
-		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-
-			foundKey, foundData := e.pullData(blockInfo)
-			sizeFoundKey := uint(len(foundKey))
-			if sizeFoundKey == blockInfo.sizeKey {
-				var sumFoundKey uint
-				for i := 0; i < len(foundKey); i++ {
-					sumFoundKey += uint(foundKey[i])
-				}
-
-				if sumFoundKey == blockInfo.sumKey {
-					var sumFoundMd5 uint
-					keyMd5 := e.md5(foundKey)
-					for i := 0; i < len(keyMd5); i++ {
-						sumFoundMd5 += uint(keyMd5[i])
-					}
-					if sumFoundMd5 == blockInfo.sumMd5 {
-						// success
-						if currentSkip < skip {
-							currentSkip += 1
-						} else {
-							result = append(result, Item{
-								Key:  foundKey,
-								Data: foundData,
-							})
-							current += 1
-						}
-					}
-				}
-			}
-
-			blockInfo = emptyBlock
-		case cEnd:
-			break
-		default:
-			tmpGroup = append(tmpGroup, v)
+		item, ok, err := e.pullItem(listBlock[i], idx.head.flags)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if currentSkip < skip {
+			currentSkip += 1
+			continue
 		}
+		result = append(result, item)
+		current += 1
 	}
-	return result
+	return result, nil
 }
 
 // FindNext returns up to limit items starting from key.
 //
 // If onlyAfterKey is true, results begin strictly after the provided key.
 // If onlyAfterKey is false, results may include the provided key if it exists.
+//
+// Read errors are reported as an empty result; use FindNextE to see them.
 func (e *Bucket) FindNext(key []byte, limit uint8, onlyAfterKey bool) []Item {
-	_, listBlockData := e.getListConfig()
-	return e.getFindNextData(
-		listBlockData,
-		key,
-		limit,
-		onlyAfterKey,
-	)
+	result, _ := e.FindNextE(key, limit, onlyAfterKey)
+	return result
+}
+
+// FindNextE is like FindNext but reports errors reading the index or the blocks.
+func (e *Bucket) FindNextE(key []byte, limit uint8, onlyAfterKey bool) (result []Item, err error) {
+	err = e.view(context.Background(), func(idx *index) error {
+		result, err = e.getFindNextData(
+			idx,
+			key,
+			limit,
+			onlyAfterKey,
+		)
+		return err
+	})
+	return result, err
 }
 
 func (e *Bucket) getFindNextData(
-	listBlockData []byte,
+	idx *index,
 	key []byte,
 	limit uint8,
 	onlyAfterKey bool,
-) []Item {
+) ([]Item, error) {
 	var result []Item
-
-	sizeCurrentKey := uint(len(key))
-	var sumCurrentKey uint
-	for i := 0; i < len(key); i++ {
-		sumCurrentKey += uint(key[i])
+	pos, err := e.findKey(idx, key)
+	if err != nil || pos < 0 {
+		return nil, err
 	}
-	var sumCurrentMd5 uint
-	keyCurrentMd5 := e.md5(key)
-	for i := 0; i < len(keyCurrentMd5); i++ {
-		sumCurrentMd5 += uint(keyCurrentMd5[i])
-	}
-	checkIsBegin := false
-
-	blockInfo := emptyBlock
-	var tmpGroup []byte
+	now := time.Now()
+	listBlock := idx.listBlock
 	var current uint8 = 0
-	for i := 0; i < len(listBlockData); i++ {
-		if current >= limit {
-			break
+	for i := pos; i < len(listBlock) && current < limit; i++ {
+		// A delayed key is still the starting point when it is not returned.
+		if listBlock[i].dead || !listBlock[i].due(now) && !(i == pos && onlyAfterKey) {
+			continue
 		}
-		v := listBlockData[i]
-		switch v {
-		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-			if !checkIsBegin && blockInfo.sizeKey == sizeCurrentKey &&
-				blockInfo.sumKey == sumCurrentKey &&
-				blockInfo.sumMd5 == sumCurrentMd5 {
-				foundKey := e.pullKey(blockInfo)
-				checkIsBegin = bytes.Equal(foundKey, key)
-			}
-			if checkIsBegin {
-				foundKey, foundData := e.pullData(blockInfo)
-				sizeFoundKey := uint(len(foundKey))
-				if sizeFoundKey == blockInfo.sizeKey {
-					var sumFoundKey uint
-					for i := 0; i < len(foundKey); i++ {
-						sumFoundKey += uint(foundKey[i])
-					}
-					if sumFoundKey == blockInfo.sumKey {
-						var sumFoundMd5 uint
-						keyMd5 := e.md5(foundKey)
-						for i := 0; i < len(keyMd5); i++ {
-							sumFoundMd5 += uint(keyMd5[i])
-						}
-						if sumFoundMd5 == blockInfo.sumMd5 {
-							if !onlyAfterKey || current > 0 {
-								result = append(result, Item{
-									Key:  foundKey,
-									Data: foundData,
-								})
-							}
-							current += 1
-						}
-					}
-				}
-			}
-
-			blockInfo = emptyBlock
-		case cEnd:
-			break
-		default:
-			tmpGroup = append(tmpGroup, v)
+		item, ok, err := e.pullItem(listBlock[i], idx.head.flags)
+		if err != nil {
+			return nil, err
 		}
+		if !ok {
+			continue
+		}
+		if !onlyAfterKey || current > 0 {
+			result = append(result, item)
+		}
+		current += 1
 	}
-	return result
+	return result, nil
 }
 
 // DeleteTo deletes items from the start of the bucket up to key.
 //
 // If alsoDeleteTheFoundBlock is true, the block/item matching key is also deleted.
 // If false, deletion stops before the block/item that matches key.
-func (e *Bucket) DeleteTo(key []byte, alsoDeleteTheFoundBlock bool) error {
-	_ = syscall.Flock(int(e.fd), syscall.LOCK_EX)
-	defer syscall.Flock(int(e.fd), syscall.LOCK_UN)
-	e.mu.Lock()
-	defer e.mu.Unlock()
+func (e *Bucket) DeleteTo(key []byte, alsoDeleteTheFoundBlock bool, opts ...WriteOption) error {
+	return e.DeleteToCtx(context.Background(), key, alsoDeleteTheFoundBlock, opts...)
+}
 
-	startListPoint, listBlockData := e.getListConfig()
-	return e.deleteToData(
-		startListPoint,
-		listBlockData,
-		alsoDeleteTheFoundBlock,
-		key,
-	)
+// DeleteToCtx is like DeleteTo but gives up waiting for the file lock when ctx
+// is done, returning ErrLockTimeout.
+func (e *Bucket) DeleteToCtx(
+	ctx context.Context,
+	key []byte,
+	alsoDeleteTheFoundBlock bool,
+	opts ...WriteOption,
+) error {
+	return e.update(ctx, opts, func(idx *index) error {
+		return e.deleteToData(
+			idx,
+			alsoDeleteTheFoundBlock,
+			key,
+		)
+	})
 }
 
 func (e *Bucket) deleteToData(
-	startListPoint uint,
-	listBlockData []byte,
+	idx *index,
 	alsoDeleteTheFoundBlock bool,
 	key []byte,
 ) error {
-	var thisFoundIndex int
-	var thisFoundFinishIndex int
-	lastFoundBlockInfo := emptyBlock
-
-	var blockControlIndexBefore int
-	blockInfo := emptyBlock
-	var tmpGroup []byte
-
-	sizeCurrentKey := uint(len(key))
-	var sumCurrentKey uint
-	for i := 0; i < len(key); i++ {
-		sumCurrentKey += uint(key[i])
+	positions, err := e.keyPositions(idx, key)
+	if err != nil || len(positions) == 0 {
+		return err
 	}
-	var sumCurrentMd5 uint
-	keyCurrentMd5 := e.md5(key)
-	for i := 0; i < len(keyCurrentMd5); i++ {
-		sumCurrentMd5 += uint(keyCurrentMd5[i])
+	pos := positions[len(positions)-1]
+	if alsoDeleteTheFoundBlock {
+		pos++
 	}
-
-	for i := 0; i < len(listBlockData); i++ {
-		v := listBlockData[i]
-		switch v {
-		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-			if blockInfo.sizeKey == sizeCurrentKey && blockInfo.sumKey == sumCurrentKey &&
-				blockInfo.sumMd5 == sumCurrentMd5 {
-				foundKey := e.pullKey(blockInfo)
-				if bytes.Equal(foundKey, key) {
-					// success
-					lastFoundBlockInfo = blockInfo
-					thisFoundIndex = blockControlIndexBefore + 1
-					thisFoundFinishIndex = i + 1
-				}
-			}
-			blockControlIndexBefore = i
-			blockInfo = emptyBlock
-		case cEnd:
-			break
-		default:
-			tmpGroup = append(tmpGroup, v)
+	// Dead letters are not part of the deleted range.
+	newListBlock := make([]block, 0, len(idx.listBlock))
+	for i := 0; i < pos; i++ {
+		if idx.listBlock[i].dead {
+			newListBlock = append(newListBlock, idx.listBlock[i])
 		}
 	}
-	if thisFoundIndex == 0 || lastFoundBlockInfo.start == 0 || lastFoundBlockInfo.sizeKey == 0 ||
-		lastFoundBlockInfo.sumKey == 0 ||
-		lastFoundBlockInfo.sumMd5 == 0 {
-		return nil
-	}
-	var err error
-	if alsoDeleteTheFoundBlock {
-		_, err = e.updateListBlock(
-			startListPoint,
-			listBlockData[thisFoundFinishIndex:],
-		)
-	} else {
-		_, err = e.updateListBlock(
-			startListPoint,
-			listBlockData[thisFoundIndex:],
-		)
-	}
-	return err
+	newListBlock = append(newListBlock, idx.listBlock[pos:]...)
+	e.updateListBlock(e.newSpaceAllocator(idx.listBlock), newListBlock)
+	return nil
 }
 
 // ListLockDelete returns up to limit items and deletes them as part of the operation.
@@ -1145,84 +1892,87 @@ func (e *Bucket) deleteToData(
 // This method is intended for queue/worker patterns (consume-and-delete).
 // Implementations may lock the underlying file to prevent concurrent consumers
 // from reading the same batch.
-func (e *Bucket) ListLockDelete(limit uint8) []Item {
-	_ = syscall.Flock(int(e.fd), syscall.LOCK_EX)
-	defer syscall.Flock(int(e.fd), syscall.LOCK_UN)
-	e.mu.Lock()
-	defer e.mu.Unlock()
+//
+// Errors are reported as an empty result; use ListLockDeleteE to see them.
+func (e *Bucket) ListLockDelete(limit uint8, opts ...WriteOption) []Item {
+	result, _ := e.ListLockDeleteE(limit, opts...)
+	return result
+}
 
-	startListPoint, listBlockData := e.getListConfig()
-	return e.getListLockDeleteData(startListPoint, listBlockData, limit)
+// ListLockDeleteE is like ListLockDelete but reports errors. When an error is
+// returned no item has been deleted.
+func (e *Bucket) ListLockDeleteE(limit uint8, opts ...WriteOption) (result []Item, err error) {
+	return e.ListLockDeleteCtx(context.Background(), limit, opts...)
 }
 
-func (e *Bucket) getListLockDeleteData(
-	startListPoint uint,
-	listBlockData []byte,
+// ListLockDeleteCtx is like ListLockDeleteE but gives up waiting for the file
+// lock when ctx is done, returning ErrLockTimeout.
+func (e *Bucket) ListLockDeleteCtx(
+	ctx context.Context,
 	limit uint8,
-) []Item {
+	opts ...WriteOption,
+) (result []Item, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		result, err = e.getListLockDeleteData(idx, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (e *Bucket) getListLockDeleteData(idx *index, limit uint8) ([]Item, error) {
+	listBlock := idx.listBlock
+	now := time.Now()
 	var result []Item
-	blockInfo := emptyBlock
-	var tmpGroup []byte
 	var current uint8 = 0
-	var endKey []byte
-	for i := 0; i < len(listBlockData); i++ {
+	// Leased blocks and dead letters are skipped, not consumed.
+	consumed := map[int]bool{}
+	for _, i := range consumeOrder(listBlock) {
 		if current >= limit {
 			break
 		}
-		v := listBlockData[i]
-		switch v {
-		case cStart:
-			blockInfo.start = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeKey:
-			blockInfo.sizeKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumKey:
-			blockInfo.sumKey = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSumMd5:
-			blockInfo.sumMd5 = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-		case cSizeData:
-			blockInfo.sizeData = e.digitsToNumber(tmpGroup)
-			tmpGroup = []byte{}
-
-			foundKey, foundData := e.pullData(blockInfo)
-			sizeFoundKey := uint(len(foundKey))
-			if sizeFoundKey == blockInfo.sizeKey {
-				var sumFoundKey uint
-				for i := 0; i < len(foundKey); i++ {
-					sumFoundKey += uint(foundKey[i])
-				}
-
-				if sumFoundKey == blockInfo.sumKey {
-					var sumFoundMd5 uint
-					keyMd5 := e.md5(foundKey)
-					for i := 0; i < len(keyMd5); i++ {
-						sumFoundMd5 += uint(keyMd5[i])
-					}
-					if sumFoundMd5 == blockInfo.sumMd5 {
-						// success
-						endKey = foundKey
-						result = append(result, Item{
-							Key:  foundKey,
-							Data: foundData,
-						})
-						current += 1
-					}
-				}
-			}
-
-			blockInfo = emptyBlock
-		case cEnd:
-			break
-		default:
-			tmpGroup = append(tmpGroup, v)
+		if !listBlock[i].visible(now) {
+			continue
+		}
+		item, ok, err := e.pullItem(listBlock[i], idx.head.flags)
+		if err != nil {
+			return nil, err
 		}
+		consumed[i] = true
+		if !ok {
+			continue
+		}
+		result = append(result, item)
+		current += 1
 	}
-	err := e.deleteToData(startListPoint, listBlockData, true, endKey)
-	if err != nil {
-		return nil
+	if len(result) == 0 {
+		return result, nil
 	}
-	return result
+	newListBlock := make([]block, 0, len(listBlock))
+	for i := 0; i < len(listBlock); i++ {
+		if !consumed[i] {
+			newListBlock = append(newListBlock, listBlock[i])
+		}
+	}
+	e.updateListBlock(e.newSpaceAllocator(listBlock), newListBlock)
+	return result, nil
+}
+
+// consumeOrder returns the positions of listBlock in the order consumers take
+// them: highest priority first, in list order within a priority.
+func consumeOrder(listBlock []block) []int {
+	order := make([]int, len(listBlock))
+	prioritized := false
+	for i := 0; i < len(listBlock); i++ {
+		order[i] = i
+		prioritized = prioritized || listBlock[i].priority != 0
+	}
+	if prioritized {
+		slices.SortStableFunc(order, func(a, b int) int {
+			return cmp.Compare(listBlock[b].priority, listBlock[a].priority)
+		})
+	}
+	return order
 }
@@ -1,6 +1,9 @@
 package blockbucketgo_test
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
@@ -18,6 +21,7 @@ func newTempBucket(t *testing.T) (path string, b *blockbucketgo.Bucket) {
 	t.Cleanup(func() {
 		b.Close()
 		_ = os.Remove(path)
+		_ = os.Remove(path + "-wal")
 	})
 	return path, b
 }
@@ -118,3 +122,213 @@ func TestListLockDelete(t *testing.T) {
 		t.Fatalf("ListLockDelete returned duplicate items")
 	}
 }
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := blockbucketgo.Open(filepath.Join(dir, "missing", "data.db"))
+	var openErr *blockbucketgo.OpenError
+	if !errors.As(err, &openErr) || openErr.Op != "open" {
+		t.Fatalf("Open in missing dir: got %v, want *OpenError with Op open", err)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open in missing dir: got %v, want fs.ErrNotExist", err)
+	}
+
+	path := filepath.Join(dir, "random.bin")
+	if err = os.WriteFile(path, []byte("this is not a bucket file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := blockbucketgo.Open(path)
+	if b != nil || !errors.Is(err, blockbucketgo.ErrInvalidFormat) {
+		t.Fatalf("Open random file: got (%v, %v), want ErrInvalidFormat", b, err)
+	}
+	if blockbucketgo.New(path) != nil {
+		t.Fatalf("New random file: expected nil Bucket")
+	}
+
+	// A legacy header must point past the header region.
+	if err = os.WriteFile(path, []byte{0xff, 0xff, 'x'}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = blockbucketgo.Open(path); b != nil ||
+		!errors.Is(err, blockbucketgo.ErrInvalidFormat) {
+		t.Fatalf("Open file with empty legacy header: got (%v, %v), want ErrInvalidFormat", b, err)
+	}
+}
+
+func TestOpenReopen(t *testing.T) {
+	path, b := newTempBucket(t)
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+
+	b2, err := blockbucketgo.Open(path, blockbucketgo.FileMode(0o600))
+	if err != nil {
+		t.Fatalf("Open existing: %v", err)
+	}
+	defer b2.Close()
+	if _, v := b2.Get([]byte("k")); string(v) != "v" {
+		t.Fatalf("Get after reopen: got %q want %q", v, "v")
+	}
+}
+
+func TestGetEAndListEErrors(t *testing.T) {
+	path, b := newTempBucket(t)
+
+	if _, err := b.GetE([]byte("missing")); !errors.Is(err, blockbucketgo.ErrNotFound) {
+		t.Fatalf("GetE missing: got %v want ErrNotFound", err)
+	}
+	if items, err := b.ListE(10); err != nil || len(items) != 0 {
+		t.Fatalf("ListE empty: got (%v, %v)", items, err)
+	}
+
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if v, err := b.GetE([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("GetE: got (%q, %v) want (%q, nil)", v, err, "v")
+	}
+
+	// Cut the file in the middle of the block that holds "k".
+	if err := os.Truncate(path, 129); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetE([]byte("k")); err == nil || errors.Is(err, blockbucketgo.ErrNotFound) {
+		t.Fatalf("GetE on truncated file: got %v, want a read error", err)
+	}
+	if _, err := b.ListE(10); !errors.Is(err, blockbucketgo.ErrCorrupt) {
+		t.Fatalf("ListE on truncated file: got %v, want ErrCorrupt", err)
+	}
+	if _, err := b.ListLockDeleteE(10); !errors.Is(err, blockbucketgo.ErrCorrupt) {
+		t.Fatalf("ListLockDeleteE on truncated file: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestSetManyKeepsExistingItems(t *testing.T) {
+	_, b := newTempBucket(t)
+
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("a"), Data: []byte("1")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if got := b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("a"), Data: []byte("one")},
+		{Key: []byte("b"), Data: []byte("2")},
+	}); got != 2 {
+		t.Fatalf("SetMany count: got %d want 2", got)
+	}
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("c"), Data: []byte("3")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+
+	want := map[string]string{"a": "one", "b": "2", "c": "3"}
+	for k, v := range want {
+		if got, err := b.GetE([]byte(k)); err != nil || string(got) != v {
+			t.Fatalf("GetE(%q): got (%q, %v) want %q", k, got, err, v)
+		}
+	}
+	if items, err := b.ListE(10); err != nil || len(items) != len(want) {
+		t.Fatalf("ListE: got (%d items, %v) want %d items", len(items), err, len(want))
+	}
+
+	// A repeated key is written once, with its last value.
+	if got := b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("d"), Data: []byte("4")},
+		{Key: []byte("d"), Data: []byte("four")},
+	}); got != 1 {
+		t.Fatalf("SetMany with a repeated key: got %d want 1", got)
+	}
+	if got, err := b.GetE([]byte("d")); err != nil || string(got) != "four" {
+		t.Fatalf("GetE(d): got (%q, %v) want four", got, err)
+	}
+}
+
+func TestIndexCacheSeesOtherWriters(t *testing.T) {
+	path, b := newTempBucket(t)
+
+	other, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer other.Close()
+
+	if _, err = b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("1")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if v, err := other.GetE([]byte("k")); err != nil || string(v) != "1" {
+		t.Fatalf("GetE through other bucket: got (%q, %v)", v, err)
+	}
+	if _, err = b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("2")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if v, err := other.GetE([]byte("k")); err != nil || string(v) != "2" {
+		t.Fatalf("GetE after update: got (%q, %v)", v, err)
+	}
+	if _, err = other.Delete([]byte("k")); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	if _, err := b.GetE([]byte("k")); !errors.Is(err, blockbucketgo.ErrNotFound) {
+		t.Fatalf("GetE after delete by other bucket: got %v want ErrNotFound", err)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	bucket, err := blockbucketgo.Open(filepath.Join(b.TempDir(), "data.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bucket.Close()
+
+	items := make([]blockbucketgo.Item, 10000)
+	for i := range items {
+		items[i] = blockbucketgo.Item{Key: []byte(fmt.Sprintf("key-%d", i)), Data: []byte("value")}
+	}
+	bucket.SetMany(items)
+	for i := 0; b.Loop(); i++ {
+		if _, err = bucket.GetE(items[i%len(items)].Key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path, b := newTempBucket(t)
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+
+	ro, err := blockbucketgo.Open(path, blockbucketgo.ReadOnly())
+	if err != nil {
+		t.Fatalf("Open read-only: %v", err)
+	}
+	defer ro.Close()
+	if v, err := ro.GetE([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("GetE read-only: got (%q, %v)", v, err)
+	}
+	_, err = ro.Set(blockbucketgo.Item{Key: []byte("x"), Data: []byte("y")})
+	if !errors.Is(err, blockbucketgo.ErrReadOnly) {
+		t.Fatalf("Set read-only: got %v, want ErrReadOnly", err)
+	}
+	if _, err = ro.Delete([]byte("k")); !errors.Is(err, blockbucketgo.ErrReadOnly) {
+		t.Fatalf("Delete read-only: got %v, want ErrReadOnly", err)
+	}
+	if _, err = ro.ListLockDeleteE(1); !errors.Is(err, blockbucketgo.ErrReadOnly) {
+		t.Fatalf("ListLockDeleteE read-only: got %v, want ErrReadOnly", err)
+	}
+	if n := ro.SetMany([]blockbucketgo.Item{{Key: []byte("x")}}); n != 0 {
+		t.Fatalf("SetMany read-only: got %d want 0", n)
+	}
+
+	// Commits of a writer are visible to the read-only Bucket.
+	if _, err = b.Set(blockbucketgo.Item{Key: []byte("k2"), Data: []byte("v2")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if v, err := ro.GetE([]byte("k2")); err != nil || string(v) != "v2" {
+		t.Fatalf("GetE read-only after write: got (%q, %v)", v, err)
+	}
+
+	_, err = blockbucketgo.Open(filepath.Join(t.TempDir(), "missing.db"), blockbucketgo.ReadOnly())
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open read-only missing file: got %v, want fs.ErrNotExist", err)
+	}
+}
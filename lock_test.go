@@ -0,0 +1,294 @@
+package blockbucketgo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+const (
+	hammerRoleEnv = "BLOCKBUCKET_HAMMER_ROLE"
+	hammerPathEnv = "BLOCKBUCKET_HAMMER_PATH"
+	hammerRounds  = 200
+)
+
+// TestMultiProcessHammer runs writers and readers in separate processes (the
+// test binary started again) on one file. Writers replace the pair of keys
+// "a" and "b" in one commit; readers must always see both keys with the same
+// value.
+func TestMultiProcessHammer(t *testing.T) {
+	if role := os.Getenv(hammerRoleEnv); role != "" {
+		runHammer(t, role, os.Getenv(hammerPathEnv))
+		return
+	}
+	if testing.Short() {
+		t.Skip("starts several processes")
+	}
+
+	path := filepath.Join(t.TempDir(), "hammer.db")
+	b, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("a"), Data: []byte("init")},
+		{Key: []byte("b"), Data: []byte("init")},
+	})
+	b.Close()
+
+	var cmds []*exec.Cmd
+	for _, role := range []string{"writer-1", "writer-2", "reader-1", "reader-2"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMultiProcessHammer$", "-test.v")
+		cmd.Env = append(os.Environ(), hammerRoleEnv+"="+role, hammerPathEnv+"="+path)
+		cmds = append(cmds, cmd)
+	}
+	outputs := make([][]byte, len(cmds))
+	errs := make(chan error, len(cmds))
+	for i, cmd := range cmds {
+		go func() {
+			var err error
+			outputs[i], err = cmd.CombinedOutput()
+			errs <- err
+		}()
+	}
+	var failed bool
+	for range cmds {
+		if err := <-errs; err != nil {
+			failed = true
+		}
+	}
+	if failed {
+		for i, out := range outputs {
+			t.Logf("%s:\n%s", cmds[i].Env[len(cmds[i].Env)-2], out)
+		}
+		t.Fatal("a hammer process failed")
+	}
+}
+
+func runHammer(t *testing.T, role string, path string) {
+	b, err := blockbucketgo.Open(path, blockbucketgo.Sync(blockbucketgo.SyncNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for i := 0; i < hammerRounds; i++ {
+		if role[0] == 'w' {
+			value := []byte(fmt.Sprintf("%s-%d", role, i))
+			if n := b.SetMany([]blockbucketgo.Item{
+				{Key: []byte("a"), Data: value},
+				{Key: []byte("b"), Data: value},
+			}); n != 2 {
+				t.Fatalf("round %d: SetMany wrote %d items", i, n)
+			}
+			continue
+		}
+		items, err := b.ListE(10)
+		if err != nil {
+			t.Fatalf("round %d: ListE error: %v", i, err)
+		}
+		if len(items) != 2 || string(items[0].Data) != string(items[1].Data) {
+			t.Fatalf("round %d: inconsistent snapshot %q", i, items)
+		}
+		if _, err = b.GetE([]byte("a")); err != nil && !errors.Is(err, blockbucketgo.ErrNotFound) {
+			t.Fatalf("round %d: GetE error: %v", i, err)
+		}
+	}
+	t.Log(role, "done after", strconv.Itoa(hammerRounds), "rounds")
+}
+
+// TestConcurrentReadersAndWriters mixes reads and every kind of write on one
+// Bucket from many goroutines. Run it with -race.
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	_, b := newTempBucket(t)
+
+	const rounds = 50
+	var wg sync.WaitGroup
+	check := func(items []blockbucketgo.Item) {
+		for _, it := range items {
+			if string(it.Data) != "v:"+string(it.Key) {
+				t.Errorf("item %q has value %q", it.Key, it.Data)
+			}
+		}
+	}
+
+	// Producers: Set and SetMany unique keys.
+	for p := 0; p < 2; p++ {
+		wg.Go(func() {
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("p%d-%d", p, i)
+				if p == 0 {
+					if _, err := b.Set(blockbucketgo.Item{Key: []byte(key), Data: []byte("v:" + key)}); err != nil {
+						t.Error(err)
+					}
+					continue
+				}
+				b.SetMany([]blockbucketgo.Item{
+					{Key: []byte(key), Data: []byte("v:" + key)},
+					{Key: []byte(key + "x"), Data: []byte("v:" + key + "x")},
+				})
+			}
+		})
+	}
+	// Deleter.
+	wg.Go(func() {
+		for i := 0; i < rounds; i += 3 {
+			if _, err := b.Delete([]byte(fmt.Sprintf("p0-%d", i))); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	// Consumers must never receive the same item twice.
+	var consumedMu sync.Mutex
+	consumed := map[string]bool{}
+	for c := 0; c < 2; c++ {
+		wg.Go(func() {
+			for i := 0; i < rounds; i++ {
+				items, err := b.ListLockDeleteE(3)
+				if err != nil {
+					t.Error(err)
+				}
+				check(items)
+				consumedMu.Lock()
+				for _, it := range items {
+					if consumed[string(it.Key)] {
+						t.Errorf("item %q consumed twice", it.Key)
+					}
+					consumed[string(it.Key)] = true
+				}
+				consumedMu.Unlock()
+			}
+		})
+	}
+	// Readers.
+	for r := 0; r < 4; r++ {
+		wg.Go(func() {
+			for i := 0; i < rounds; i++ {
+				items, err := b.ListE(20)
+				if err != nil {
+					t.Error(err)
+				}
+				check(items)
+				key := fmt.Sprintf("p1-%d", i)
+				if v, err := b.GetE([]byte(key)); err == nil {
+					check([]blockbucketgo.Item{{Key: []byte(key), Data: v}})
+				} else if !errors.Is(err, blockbucketgo.ErrNotFound) {
+					t.Error(err)
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
+func TestExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owned.db")
+	owner, err := blockbucketgo.Open(path, blockbucketgo.Exclusive())
+	if err != nil {
+		t.Fatalf("Open exclusive: %v", err)
+	}
+	if _, err = owner.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if v, err := owner.GetE([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("GetE: got (%q, %v)", v, err)
+	}
+
+	for _, opts := range [][]blockbucketgo.Option{
+		{blockbucketgo.Exclusive()},
+		{blockbucketgo.Exclusive(), blockbucketgo.ReadOnly()},
+	} {
+		_, err = blockbucketgo.Open(path, opts...)
+		var openErr *blockbucketgo.OpenError
+		if !errors.Is(err, blockbucketgo.ErrLocked) || !errors.As(err, &openErr) ||
+			openErr.Op != "lock" {
+			t.Fatalf("second exclusive Open: got %v, want ErrLocked", err)
+		}
+	}
+	owner.Close()
+
+	// Once closed, the file can be owned again, and holds the data.
+	reader, err := blockbucketgo.Open(path, blockbucketgo.Exclusive(), blockbucketgo.ReadOnly())
+	if err != nil {
+		t.Fatalf("Open exclusive after Close: %v", err)
+	}
+	defer reader.Close()
+	if v, err := reader.GetE([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("GetE after reopen: got (%q, %v)", v, err)
+	}
+	shared, err := blockbucketgo.Open(path, blockbucketgo.Exclusive(), blockbucketgo.ReadOnly())
+	if err != nil {
+		t.Fatalf("second shared exclusive Open: %v", err)
+	}
+	shared.Close()
+}
+
+func TestLockTimeout(t *testing.T) {
+	path, b := newTempBucket(t)
+	if _, err := b.Set(blockbucketgo.Item{Key: []byte("k"), Data: []byte("v")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+
+	// Hold the file lock through another file description, as a stuck peer
+	// process would.
+	peer, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if err = syscall.Flock(int(peer.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = b.SetCtx(ctx, blockbucketgo.Item{Key: []byte("k"), Data: []byte("v2")})
+	if !errors.Is(err, blockbucketgo.ErrLockTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SetCtx with held lock: got %v, want ErrLockTimeout", err)
+	}
+	if _, err = b.ListLockDeleteCtx(ctx, 1); !errors.Is(err, blockbucketgo.ErrLockTimeout) {
+		t.Fatalf("ListLockDeleteCtx with held lock: got %v, want ErrLockTimeout", err)
+	}
+
+	_, err = blockbucketgo.Open(path, blockbucketgo.LockTimeout(20*time.Millisecond))
+	if !errors.Is(err, blockbucketgo.ErrLockTimeout) {
+		t.Fatalf("Open with held lock: got %v, want ErrLockTimeout", err)
+	}
+
+	if err = syscall.Flock(int(peer.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := blockbucketgo.Open(path, blockbucketgo.LockTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Open after release: %v", err)
+	}
+	defer b2.Close()
+
+	if err = syscall.Flock(int(peer.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	released := make(chan struct{})
+	time.AfterFunc(30*time.Millisecond, func() {
+		_ = syscall.Flock(int(peer.Fd()), syscall.LOCK_UN)
+		close(released)
+	})
+	// The lock is released while the call waits for it.
+	if _, err = b2.Delete([]byte("k")); err != nil {
+		t.Fatalf("Delete waiting for the lock: %v", err)
+	}
+	<-released
+	if _, err = b2.GetE([]byte("k")); !errors.Is(err, blockbucketgo.ErrNotFound) {
+		t.Fatalf("GetE after Delete: got %v, want ErrNotFound", err)
+	}
+}
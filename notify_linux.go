@@ -0,0 +1,37 @@
+//go:build linux
+
+package blockbucketgo
+
+import (
+	"os"
+	"syscall"
+)
+
+// watchFile sends to changes whenever the file at path is written, until stop
+// is called. It falls back to pollFile when inotify is not available.
+func watchFile(path string, changes chan<- struct{}) (stop func()) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return pollFile(changes)
+	}
+	if _, err = syscall.InotifyAddWatch(fd, path, syscall.IN_MODIFY); err != nil {
+		_ = syscall.Close(fd)
+		return pollFile(changes)
+	}
+	// A non-blocking descriptor goes through the runtime poller, so Close
+	// interrupts the pending Read.
+	events := os.NewFile(uintptr(fd), path+" (inotify)")
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := events.Read(buf); err != nil {
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return func() { _ = events.Close() }
+}
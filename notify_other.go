@@ -0,0 +1,8 @@
+//go:build !linux
+
+package blockbucketgo
+
+// watchFile sends to changes every waitPollInterval until stop is called.
+func watchFile(path string, changes chan<- struct{}) (stop func()) {
+	return pollFile(changes)
+}
@@ -0,0 +1,397 @@
+package blockbucketgo
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"time"
+)
+
+// Lease is a batch of items handed to one consumer by Bucket.Lease. The items
+// stay hidden from other consumers until Until, and are deleted by Ack.
+type Lease struct {
+	// ID identifies the lease in the file.
+	ID uint64
+	// Until is when the items become visible again if they are not acked.
+	Until time.Time
+	// Items are the leased items, oldest first.
+	Items []Item
+}
+
+// Lease returns up to limit items, like ListLockDelete, but instead of
+// deleting them hides them from Lease and ListLockDelete calls, in this and
+// other processes, for visibilityTimeout. The consumer then calls Ack for the
+// items it processed, or Nack to hand them back at once. Items of a lease that
+// expires, e.g. because its consumer crashed, are delivered again.
+//
+// Every lease counts as a delivery of its items, see Item.Deliveries. With
+// MaxDeliveries, an item that was delivered that many times is moved to the
+// dead letters instead of being delivered again.
+//
+// Leases are stored by format 2 files only; on older files Lease fails with
+// ErrNeedsMigration. It returns a nil Lease when no item is available.
+func (e *Bucket) Lease(
+	limit uint8,
+	visibilityTimeout time.Duration,
+	opts ...WriteOption,
+) (*Lease, error) {
+	return e.LeaseCtx(context.Background(), limit, visibilityTimeout, opts...)
+}
+
+// LeaseCtx is like Lease but gives up waiting for the file lock when ctx is
+// done, returning ErrLockTimeout.
+func (e *Bucket) LeaseCtx(
+	ctx context.Context,
+	limit uint8,
+	visibilityTimeout time.Duration,
+	opts ...WriteOption,
+) (lease *Lease, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		if !storesMetadata(idx.head) {
+			return ErrNeedsMigration
+		}
+		lease, err = e.leaseData(idx, limit, visibilityTimeout)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (e *Bucket) leaseData(
+	idx *index,
+	limit uint8,
+	visibilityTimeout time.Duration,
+) (*Lease, error) {
+	now := time.Now()
+	lease := &Lease{ID: idx.head.seq + 1, Until: now.Add(visibilityTimeout)}
+	listBlock := slices.Clone(idx.listBlock)
+	changed := false
+	for _, i := range consumeOrder(listBlock) {
+		if len(lease.Items) >= int(limit) {
+			break
+		}
+		if !listBlock[i].visible(now) {
+			continue
+		}
+		if e.maxDeliveries > 0 && listBlock[i].deliveries >= uint64(e.maxDeliveries) {
+			listBlock[i].dead = true
+			listBlock[i].leaseUntil = 0
+			listBlock[i].leaseID = 0
+			changed = true
+			continue
+		}
+		item, ok, err := e.pullItem(listBlock[i], idx.head.flags)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		listBlock[i].leaseUntil = uint64(lease.Until.UnixNano())
+		listBlock[i].leaseID = lease.ID
+		listBlock[i].deliveries++
+		item.Deliveries = int(listBlock[i].deliveries)
+		lease.Items = append(lease.Items, item)
+		changed = true
+	}
+	if changed {
+		e.updateListBlock(e.newSpaceAllocator(idx.listBlock), listBlock)
+	}
+	if len(lease.Items) == 0 {
+		return nil, nil
+	}
+	return lease, nil
+}
+
+// Ack deletes the items of the lease with the given keys, or all of them when
+// keys is nil, and returns how many were deleted. Items whose lease expired and
+// that were leased again since are left alone.
+func (e *Bucket) Ack(lease *Lease, keys [][]byte, opts ...WriteOption) (int, error) {
+	return e.AckCtx(context.Background(), lease, keys, opts...)
+}
+
+// AckCtx is like Ack but gives up waiting for the file lock when ctx is done,
+// returning ErrLockTimeout.
+func (e *Bucket) AckCtx(
+	ctx context.Context,
+	lease *Lease,
+	keys [][]byte,
+	opts ...WriteOption,
+) (int, error) {
+	return e.settleLease(ctx, opts, lease, keys, func(listBlock []block, b block) []block {
+		return listBlock
+	})
+}
+
+// Nack ends the lease of the items with the given keys, or of all of them when
+// keys is nil, so that they can be consumed again at once. It returns how many
+// were released.
+func (e *Bucket) Nack(lease *Lease, keys [][]byte, opts ...WriteOption) (int, error) {
+	return e.NackCtx(context.Background(), lease, keys, opts...)
+}
+
+// NackCtx is like Nack but gives up waiting for the file lock when ctx is
+// done, returning ErrLockTimeout.
+func (e *Bucket) NackCtx(
+	ctx context.Context,
+	lease *Lease,
+	keys [][]byte,
+	opts ...WriteOption,
+) (int, error) {
+	return e.settleLease(ctx, opts, lease, keys, func(listBlock []block, b block) []block {
+		b.leaseUntil = 0
+		b.leaseID = 0
+		return append(listBlock, b)
+	})
+}
+
+// settleLease rebuilds the list without the blocks of keys still held by
+// lease, passing each of them to keep, which may append it back in place.
+func (e *Bucket) settleLease(
+	ctx context.Context,
+	opts []WriteOption,
+	lease *Lease,
+	keys [][]byte,
+	keep func(listBlock []block, b block) []block,
+) (n int, err error) {
+	if lease == nil {
+		return 0, nil
+	}
+	if len(keys) == 0 {
+		for _, item := range lease.Items {
+			keys = append(keys, item.Key)
+		}
+	}
+	err = e.update(ctx, opts, func(idx *index) error {
+		held := map[int]bool{}
+		for _, key := range keys {
+			leased := func(item Item) bool { return bytes.Equal(item.Key, key) }
+			if !slices.ContainsFunc(lease.Items, leased) {
+				continue
+			}
+			positions, err := e.keyPositions(idx, key)
+			if err != nil {
+				return err
+			}
+			for _, p := range positions {
+				if idx.listBlock[p].leaseID == lease.ID {
+					held[p] = true
+				}
+			}
+		}
+		if len(held) == 0 {
+			return nil
+		}
+		newListBlock := make([]block, 0, len(idx.listBlock))
+		for i := 0; i < len(idx.listBlock); i++ {
+			if held[i] {
+				newListBlock = keep(newListBlock, idx.listBlock[i])
+			} else {
+				newListBlock = append(newListBlock, idx.listBlock[i])
+			}
+		}
+		n = len(held)
+		e.updateListBlock(e.newSpaceAllocator(idx.listBlock), newListBlock)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// visible reports whether the block can be consumed at now, i.e. it is due
+// and neither held by a lease nor a dead letter.
+func (b block) visible(now time.Time) bool {
+	return !b.dead && b.due(now) && b.leaseUntil <= uint64(now.UnixNano())
+}
+
+// due reports whether the delay set by SetDelayed is over at now.
+func (b block) due(now time.Time) bool {
+	return b.notBefore <= uint64(now.UnixNano())
+}
+
+// SetDelayed stores item like Set, but List, ListLockDelete and Lease skip it
+// until notBefore. Get still returns it, with Item.NotBefore set. Setting the
+// key again, with Set or SetDelayed, replaces the schedule.
+//
+// Schedules are stored by format 2 files only; on older files SetDelayed fails
+// with ErrNeedsMigration.
+func (e *Bucket) SetDelayed(item Item, notBefore time.Time, opts ...WriteOption) (int, error) {
+	return e.SetDelayedCtx(context.Background(), item, notBefore, opts...)
+}
+
+// SetDelayedCtx is like SetDelayed but gives up waiting for the file lock when
+// ctx is done, returning ErrLockTimeout.
+func (e *Bucket) SetDelayedCtx(
+	ctx context.Context,
+	item Item,
+	notBefore time.Time,
+	opts ...WriteOption,
+) (n int, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		if !storesMetadata(idx.head) {
+			return ErrNeedsMigration
+		}
+		n, err = e.setDelayedData(idx, item, uint64(max(notBefore.UnixNano(), 0)))
+		return err
+	})
+	return n, err
+}
+
+// DeadLetters returns up to limit of the items that Lease gave up on after
+// MaxDeliveries, oldest first, after skipping skip of them. Dead letters are
+// kept apart from the other items: Get, List, Lease and ListLockDelete do not
+// see them, and setting their key again stores a new, live item.
+func (e *Bucket) DeadLetters(limit uint8, skip uint) (result []Item, err error) {
+	err = e.view(context.Background(), func(idx *index) error {
+		for i := 0; i < len(idx.listBlock) && len(result) < int(limit); i++ {
+			if !idx.listBlock[i].dead {
+				continue
+			}
+			item, ok, err := e.pullItem(idx.listBlock[i], idx.head.flags)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			result = append(result, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReplayDeadLetters moves the dead letters of the given keys, or all of them
+// when keys is nil, back to the end of the queue with their delivery count
+// reset. A replayed item replaces the live item of the same key, if any. It
+// returns how many items were replayed.
+func (e *Bucket) ReplayDeadLetters(keys [][]byte, opts ...WriteOption) (int, error) {
+	return e.ReplayDeadLettersCtx(context.Background(), keys, opts...)
+}
+
+// ReplayDeadLettersCtx is like ReplayDeadLetters but gives up waiting for the
+// file lock when ctx is done, returning ErrLockTimeout.
+func (e *Bucket) ReplayDeadLettersCtx(
+	ctx context.Context,
+	keys [][]byte,
+	opts ...WriteOption,
+) (n int, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		dead, err := e.deadPositions(idx, keys)
+		if err != nil {
+			return err
+		}
+		// Only the newest dead letter of a key is replayed, the others and
+		// the live item of the key are dropped.
+		drop := map[int]bool{}
+		seen := map[string]bool{}
+		var replay []block
+		for i := len(dead) - 1; i >= 0; i-- {
+			b := idx.listBlock[dead[i]]
+			drop[dead[i]] = true
+			key, err := e.pullKey(b)
+			if err != nil {
+				return err
+			}
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			positions, err := e.keyPositions(idx, key)
+			if err != nil {
+				return err
+			}
+			for _, p := range positions {
+				drop[p] = true
+			}
+			b.dead = false
+			b.deliveries = 0
+			b.version = nextVersion(idx.head)
+			replay = append(replay, b)
+		}
+		if len(replay) == 0 {
+			return nil
+		}
+		slices.Reverse(replay)
+		newListBlock := make([]block, 0, len(idx.listBlock))
+		for i := 0; i < len(idx.listBlock); i++ {
+			if !drop[i] {
+				newListBlock = append(newListBlock, idx.listBlock[i])
+			}
+		}
+		n = len(replay)
+		e.updateListBlock(e.newSpaceAllocator(idx.listBlock), append(newListBlock, replay...))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// PurgeDeadLetters deletes the dead letters of the given keys, or all of them
+// when keys is nil, and returns how many were deleted.
+func (e *Bucket) PurgeDeadLetters(keys [][]byte, opts ...WriteOption) (int, error) {
+	return e.PurgeDeadLettersCtx(context.Background(), keys, opts...)
+}
+
+// PurgeDeadLettersCtx is like PurgeDeadLetters but gives up waiting for the
+// file lock when ctx is done, returning ErrLockTimeout.
+func (e *Bucket) PurgeDeadLettersCtx(
+	ctx context.Context,
+	keys [][]byte,
+	opts ...WriteOption,
+) (n int, err error) {
+	err = e.update(ctx, opts, func(idx *index) error {
+		dead, err := e.deadPositions(idx, keys)
+		if err != nil || len(dead) == 0 {
+			return err
+		}
+		newListBlock := make([]block, 0, len(idx.listBlock))
+		for i := 0; i < len(idx.listBlock); i++ {
+			if !slices.Contains(dead, i) {
+				newListBlock = append(newListBlock, idx.listBlock[i])
+			}
+		}
+		n = len(dead)
+		e.updateListBlock(e.newSpaceAllocator(idx.listBlock), newListBlock)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// deadPositions returns the positions in idx of the dead letters of keys, or
+// of all dead letters when keys is nil, in list order.
+func (e *Bucket) deadPositions(idx *index, keys [][]byte) ([]int, error) {
+	var positions []int
+	for i := 0; i < len(idx.listBlock); i++ {
+		if !idx.listBlock[i].dead {
+			continue
+		}
+		if len(keys) > 0 {
+			key, err := e.pullKey(idx.listBlock[i])
+			if err != nil {
+				return nil, err
+			}
+			if !slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, key) }) {
+				continue
+			}
+		}
+		positions = append(positions, i)
+	}
+	return positions, nil
+}
@@ -0,0 +1,278 @@
+package blockbucketgo_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+func TestLeaseAckNack(t *testing.T) {
+	path, b := newTempBucket(t)
+	b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("job-1"), Data: []byte("a")},
+		{Key: []byte("job-2"), Data: []byte("b")},
+		{Key: []byte("job-3"), Data: []byte("c")},
+	})
+	other, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	lease, err := b.Lease(2, time.Minute)
+	if err != nil || lease == nil || len(lease.Items) != 2 ||
+		string(lease.Items[0].Key) != "job-1" {
+		t.Fatalf("Lease: got (%+v, %v)", lease, err)
+	}
+	// Leased items are hidden from other consumers, but not from reads.
+	batch, err := other.ListLockDeleteE(10)
+	if err != nil || len(batch) != 1 || string(batch[0].Key) != "job-3" {
+		t.Fatalf("ListLockDeleteE during lease: got (%q, %v) want job-3", batch, err)
+	}
+	if l, err := other.Lease(10, time.Minute); err != nil || l != nil {
+		t.Fatalf("Lease with everything leased: got (%+v, %v) want nil", l, err)
+	}
+	if v, err := other.GetE([]byte("job-1")); err != nil || string(v) != "a" {
+		t.Fatalf("GetE of a leased item: got (%q, %v)", v, err)
+	}
+
+	if n, err := b.Ack(lease, [][]byte{[]byte("job-1")}); err != nil || n != 1 {
+		t.Fatalf("Ack job-1: got (%d, %v) want 1", n, err)
+	}
+	if n, err := b.Nack(lease, nil); err != nil || n != 1 {
+		t.Fatalf("Nack: got (%d, %v) want 1", n, err)
+	}
+	again, err := other.Lease(10, time.Millisecond)
+	if err != nil || again == nil || len(again.Items) != 1 ||
+		string(again.Items[0].Key) != "job-2" {
+		t.Fatalf("Lease after Nack: got (%+v, %v) want job-2", again, err)
+	}
+
+	// The consumer of again dies: its lease expires and job-2 comes back.
+	time.Sleep(time.Until(again.Until))
+	last, err := b.Lease(10, time.Minute)
+	if err != nil || last == nil || len(last.Items) != 1 || string(last.Items[0].Key) != "job-2" {
+		t.Fatalf("Lease after expiry: got (%+v, %v) want job-2", last, err)
+	}
+	// The expired lease no longer owns the item.
+	if n, err := other.Ack(again, nil); err != nil || n != 0 {
+		t.Fatalf("Ack of an expired lease: got (%d, %v) want 0", n, err)
+	}
+	if n, err := b.Ack(last, nil, blockbucketgo.WriteSync(blockbucketgo.SyncCommit)); err != nil ||
+		n != 1 {
+		t.Fatalf("Ack: got (%d, %v) want 1", n, err)
+	}
+	if items, err := b.ListE(10); err != nil || len(items) != 0 {
+		t.Fatalf("ListE after Ack: got (%q, %v) want empty", items, err)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.db")
+	b, err := blockbucketgo.Open(path, blockbucketgo.MaxDeliveries(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("poison"), Data: []byte("a")},
+		{Key: []byte("fine"), Data: []byte("b")},
+	})
+
+	for want := 1; want <= 2; want++ {
+		lease, err := b.Lease(1, time.Minute)
+		if err != nil || lease == nil || string(lease.Items[0].Key) != "poison" ||
+			lease.Items[0].Deliveries != want {
+			t.Fatalf("delivery %d: got (%+v, %v)", want, lease, err)
+		}
+		b.Nack(lease, nil)
+	}
+	// The third delivery would exceed MaxDeliveries: poison is dead-lettered.
+	lease, err := b.Lease(1, time.Minute)
+	if err != nil || lease == nil || string(lease.Items[0].Key) != "fine" {
+		t.Fatalf("Lease after MaxDeliveries: got (%+v, %v) want fine", lease, err)
+	}
+	if v, err := b.GetE([]byte("poison")); !errors.Is(err, blockbucketgo.ErrNotFound) {
+		t.Fatalf("GetE of a dead letter: got (%q, %v) want ErrNotFound", v, err)
+	}
+	dead, err := b.DeadLetters(10, 0)
+	if err != nil || len(dead) != 1 || string(dead[0].Key) != "poison" || dead[0].Deliveries != 2 {
+		t.Fatalf("DeadLetters: got (%+v, %v) want poison", dead, err)
+	}
+
+	// Dead letters survive a DeleteTo of the live items.
+	b.Set(blockbucketgo.Item{Key: []byte("poison"), Data: []byte("new")})
+	b.DeleteTo([]byte("poison"), true)
+	if dead, _ = b.DeadLetters(10, 0); len(dead) != 1 {
+		t.Fatalf("DeadLetters after DeleteTo: got %+v", dead)
+	}
+
+	b.Set(blockbucketgo.Item{Key: []byte("poison"), Data: []byte("newer")})
+	if n, err := b.ReplayDeadLetters(nil); err != nil || n != 1 {
+		t.Fatalf("ReplayDeadLetters: got (%d, %v) want 1", n, err)
+	}
+	item, err := b.GetItem([]byte("poison"))
+	if err != nil || string(item.Data) != "a" || item.Deliveries != 0 {
+		t.Fatalf("GetItem after replay: got (%+v, %v) want the dead letter", item, err)
+	}
+	if dead, _ = b.DeadLetters(10, 0); len(dead) != 0 {
+		t.Fatalf("DeadLetters after replay: got %+v", dead)
+	}
+
+	for i := 0; i < 3; i++ {
+		if lease, _ := b.Lease(1, time.Minute); lease != nil {
+			b.Nack(lease, nil)
+		}
+	}
+	if n, err := b.PurgeDeadLetters([][]byte{[]byte("poison")}); err != nil || n != 1 {
+		t.Fatalf("PurgeDeadLetters: got (%d, %v) want 1", n, err)
+	}
+	if dead, _ = b.DeadLetters(10, 0); len(dead) != 0 {
+		t.Fatalf("DeadLetters after purge: got %+v", dead)
+	}
+}
+
+func TestSetDelayed(t *testing.T) {
+	_, b := newTempBucket(t)
+	at := time.Now().Add(time.Hour)
+	if _, err := b.SetDelayed(blockbucketgo.Item{Key: []byte("later"), Data: []byte("a")}, at); err != nil {
+		t.Fatal(err)
+	}
+	b.Set(blockbucketgo.Item{Key: []byte("now"), Data: []byte("b")})
+
+	if items, err := b.ListE(10); err != nil || len(items) != 1 || string(items[0].Key) != "now" {
+		t.Fatalf("ListE before the delay: got (%q, %v) want now", items, err)
+	}
+	if items := b.FindNext([]byte("later"), 10, true); len(items) != 1 ||
+		string(items[0].Key) != "now" {
+		t.Fatalf("FindNext after a delayed key: got %q want now", items)
+	}
+	if item, err := b.GetItem([]byte("later")); err != nil || !item.NotBefore.Equal(at) {
+		t.Fatalf("GetItem of a delayed item: got (%+v, %v) want NotBefore %v", item, err, at)
+	}
+	if items, err := b.ListLockDeleteE(10); err != nil || len(items) != 1 ||
+		string(items[0].Key) != "now" {
+		t.Fatalf("ListLockDeleteE before the delay: got (%q, %v) want now", items, err)
+	}
+	if l, err := b.Lease(10, time.Minute); err != nil || l != nil {
+		t.Fatalf("Lease before the delay: got (%+v, %v) want nil", l, err)
+	}
+
+	// Modify keeps the schedule.
+	b.SetDelayed(
+		blockbucketgo.Item{Key: []byte("counter"), Data: []byte("1")},
+		time.Now().Add(time.Hour),
+	)
+	if v, err := b.Increment([]byte("counter"), 1); err != nil || v != 2 {
+		t.Fatalf("Increment of a delayed counter: got (%d, %v) want 2", v, err)
+	}
+
+	soon := time.Now().Add(time.Millisecond)
+	b.SetDelayed(blockbucketgo.Item{Key: []byte("soon"), Data: []byte("c")}, soon)
+	time.Sleep(time.Until(soon))
+	if items, err := b.ListLockDeleteE(10); err != nil || len(items) != 1 ||
+		string(items[0].Key) != "soon" {
+		t.Fatalf("ListLockDeleteE after the delay: got (%q, %v) want soon", items, err)
+	}
+
+	// CompareAndSwap keeps the schedule too.
+	if ok, err := b.CompareAndSwap([]byte("counter"), []byte("2"), []byte("3")); err != nil || !ok {
+		t.Fatalf("CompareAndSwap of a delayed counter: got (%v, %v) want true", ok, err)
+	}
+	if items, err := b.ListE(10); err != nil || len(items) != 0 {
+		t.Fatalf("ListE after CompareAndSwap: got (%q, %v) want empty", items, err)
+	}
+
+	// Modify and CompareAndSwap keep the lease, so the item stays hidden and
+	// can be acked, and the place of the item in the queue.
+	b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("job-1"), Data: []byte("a")},
+		{Key: []byte("job-2"), Data: []byte("b")},
+		{Key: []byte("job-3"), Data: []byte("c")},
+	})
+	lease, err := b.Lease(1, time.Minute)
+	if err != nil || lease == nil || string(lease.Items[0].Key) != "job-1" {
+		t.Fatalf("Lease: got (%+v, %v) want job-1", lease, err)
+	}
+	if err = b.Modify([]byte("job-1"), func(old []byte) ([]byte, error) { return append(old, 'b'), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.CompareAndSwap([]byte("job-1"), []byte("ab"), []byte("abc")); err != nil ||
+		!ok {
+		t.Fatalf("CompareAndSwap of a leased item: got (%v, %v) want true", ok, err)
+	}
+	if err = b.Modify([]byte("job-2"), func(old []byte) ([]byte, error) { return append(old, 'b'), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := b.ListLockDeleteE(1); err != nil || len(items) != 1 ||
+		string(items[0].Key) != "job-2" {
+		t.Fatalf("ListLockDeleteE after Modify: got (%q, %v) want job-2", items, err)
+	}
+	if n, err := b.Ack(lease, nil); err != nil || n != 1 {
+		t.Fatalf("Ack after Modify: got (%d, %v) want 1", n, err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	_, b := newTempBucket(t)
+	b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("low-1"), Data: []byte("a")},
+		{Key: []byte("urgent-1"), Data: []byte("b"), Priority: 10},
+		{Key: []byte("low-2"), Data: []byte("c")},
+		{Key: []byte("background"), Data: []byte("d"), Priority: -1},
+	})
+	b.Set(blockbucketgo.Item{Key: []byte("urgent-2"), Data: []byte("e"), Priority: 10})
+	b.Set(blockbucketgo.Item{Key: []byte("high"), Data: []byte("f"), Priority: 5})
+
+	// Reads keep the list order.
+	if items, _ := b.ListE(1); len(items) != 1 || string(items[0].Key) != "low-1" {
+		t.Fatalf("ListE: got %q want low-1 first", items)
+	}
+	if item, err := b.GetItem([]byte("background")); err != nil || item.Priority != -1 {
+		t.Fatalf("GetItem: got (%+v, %v) want Priority -1", item, err)
+	}
+	// Rewriting the value keeps the priority.
+	if ok, err := b.CompareAndSwap([]byte("high"), []byte("f"), []byte("f")); err != nil || !ok {
+		t.Fatalf("CompareAndSwap: got (%v, %v) want (true, nil)", ok, err)
+	}
+	if item, err := b.GetItem([]byte("high")); err != nil || item.Priority != 5 {
+		t.Fatalf("GetItem after CompareAndSwap: got (%+v, %v) want Priority 5", item, err)
+	}
+
+	lease, err := b.Lease(3, time.Minute)
+	if err != nil || lease == nil {
+		t.Fatalf("Lease: got (%+v, %v)", lease, err)
+	}
+	var got []string
+	for _, it := range lease.Items {
+		got = append(got, string(it.Key))
+	}
+	batch, err := b.ListLockDeleteE(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range batch {
+		got = append(got, string(it.Key))
+	}
+	want := []string{"urgent-1", "urgent-2", "high", "low-1", "low-2", "background"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("consume order: got %v want %v", got, want)
+	}
+
+	// Priorities set in a transaction are kept.
+	b.Set(blockbucketgo.Item{Key: []byte("plain"), Data: []byte("g")})
+	err = b.Update(func(tx *blockbucketgo.Tx) error {
+		return tx.Set(blockbucketgo.Item{Key: []byte("tx-urgent"), Data: []byte("h"), Priority: 5})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch, err = b.ListLockDeleteE(1); err != nil || len(batch) != 1 ||
+		string(batch[0].Key) != "tx-urgent" {
+		t.Fatalf("ListLockDeleteE after Update: got (%q, %v) want tx-urgent", batch, err)
+	}
+}
@@ -0,0 +1,131 @@
+package blockbucketgo
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// ErrTxClosed is returned by the methods of a Tx used after its Update returned.
+var ErrTxClosed = errors.New("blockbucketgo: transaction is closed")
+
+// Tx is a read-write transaction started by Update. Its changes are buffered
+// and committed together when the Update callback returns.
+//
+// A Tx must only be used by the goroutine running the callback.
+type Tx struct {
+	e      *Bucket
+	idx    *index
+	writes []txWrite
+	closed bool
+}
+
+// txWrite is one buffered Set or Delete.
+type txWrite struct {
+	item    Item
+	deleted bool
+}
+
+// Update runs fn in a read-write transaction. The file lock is held for the
+// whole call, so no other writer commits in between.
+//
+// If fn returns nil, every change made through tx is committed at once, with a
+// single new index list. If fn returns an error nothing is written and Update
+// returns that error.
+//
+// fn runs with the Bucket locked: it must only use tx, as calling any method
+// of the Bucket from fn deadlocks.
+func (e *Bucket) Update(fn func(tx *Tx) error, opts ...WriteOption) error {
+	return e.UpdateCtx(context.Background(), fn, opts...)
+}
+
+// UpdateCtx is like Update but gives up waiting for the file lock when ctx is
+// done, returning ErrLockTimeout.
+func (e *Bucket) UpdateCtx(ctx context.Context, fn func(tx *Tx) error, opts ...WriteOption) error {
+	return e.update(ctx, opts, func(idx *index) error {
+		tx := &Tx{e: e, idx: idx}
+		defer func() { tx.closed = true }()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.commit()
+	})
+}
+
+// Get returns the value of key as seen by the transaction, including its own
+// changes. It returns ErrNotFound if the key does not exist.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if tx.closed {
+		return nil, ErrTxClosed
+	}
+	for i := len(tx.writes) - 1; i >= 0; i-- {
+		w := tx.writes[i]
+		if string(w.item.Key) != string(key) {
+			continue
+		}
+		if w.deleted {
+			return nil, ErrNotFound
+		}
+		return slices.Clone(w.item.Data), nil
+	}
+	item, err := tx.e.getOneData(tx.idx, key)
+	if err != nil {
+		return nil, err
+	}
+	return item.Data, nil
+}
+
+// Set writes or updates item when the transaction commits.
+func (tx *Tx) Set(item Item) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	tx.writes = append(tx.writes, txWrite{item: Item{
+		Key:      slices.Clone(item.Key),
+		Data:     slices.Clone(item.Data),
+		Priority: item.Priority,
+	}})
+	return nil
+}
+
+// Delete removes key when the transaction commits.
+func (tx *Tx) Delete(key []byte) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	tx.writes = append(tx.writes, txWrite{item: Item{Key: slices.Clone(key)}, deleted: true})
+	return nil
+}
+
+// commit queues the buffered changes as one new list: the keys touched by the
+// transaction are dropped from the list, and the ones still set at the end are
+// appended in the order of their last Set.
+func (tx *Tx) commit() error {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	last := map[string]int{}
+	for i, w := range tx.writes {
+		last[string(w.item.Key)] = i
+	}
+	touched := make([]Item, 0, len(last))
+	var sets []Item
+	for i, w := range tx.writes {
+		if last[string(w.item.Key)] != i {
+			continue
+		}
+		touched = append(touched, w.item)
+		if !w.deleted {
+			sets = append(sets, w.item)
+		}
+	}
+	if err := checkPriority(tx.idx.head, sets...); err != nil {
+		return err
+	}
+	newListBlock, err := tx.e.getNewListNotContainListKey(tx.idx, touched)
+	if err != nil {
+		return err
+	}
+	tx.e.appendItems(tx.idx, newListBlock, sets)
+	return nil
+}
@@ -0,0 +1,65 @@
+package blockbucketgo_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+func TestUpdate(t *testing.T) {
+	_, b := newTempBucket(t)
+	b.SetMany([]blockbucketgo.Item{
+		{Key: []byte("job-1"), Data: []byte("pending")},
+		{Key: []byte("job-2"), Data: []byte("pending")},
+	})
+
+	// Move job-1 to a done key atomically.
+	var tx *blockbucketgo.Tx
+	err := b.Update(func(t2 *blockbucketgo.Tx) error {
+		tx = t2
+		v, err := t2.Get([]byte("job-1"))
+		if err != nil {
+			return err
+		}
+		if err = t2.Delete([]byte("job-1")); err != nil {
+			return err
+		}
+		if _, err = t2.Get([]byte("job-1")); !errors.Is(err, blockbucketgo.ErrNotFound) {
+			t.Errorf("Get after Delete in tx: got %v, want ErrNotFound", err)
+		}
+		if err = t2.Set(blockbucketgo.Item{Key: []byte("done-1"), Data: append(v, "+done"...)}); err != nil {
+			return err
+		}
+		if v, err := t2.Get([]byte("done-1")); err != nil || string(v) != "pending+done" {
+			t.Errorf("Get after Set in tx: got (%q, %v)", v, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+	items, err := b.ListE(10)
+	if err != nil || len(items) != 2 || string(items[0].Key) != "job-2" ||
+		string(items[1].Key) != "done-1" {
+		t.Fatalf("ListE after Update: got (%q, %v)", items, err)
+	}
+	err = tx.Set(blockbucketgo.Item{Key: []byte("late")})
+	if !errors.Is(err, blockbucketgo.ErrTxClosed) {
+		t.Fatalf("Set after Update: got %v, want ErrTxClosed", err)
+	}
+
+	// An error from the callback rolls everything back.
+	errAbort := errors.New("abort")
+	err = b.Update(func(tx *blockbucketgo.Tx) error {
+		_ = tx.Delete([]byte("job-2"))
+		_ = tx.Set(blockbucketgo.Item{Key: []byte("other"), Data: []byte("x")})
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Update with error: got %v, want errAbort", err)
+	}
+	if items, err = b.ListE(10); err != nil || len(items) != 2 {
+		t.Fatalf("ListE after rollback: got (%q, %v)", items, err)
+	}
+}
@@ -0,0 +1,160 @@
+package blockbucketgo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// viewSuffix names the sidecar file that open Views share-lock. Writers, in
+// any process, test the lock and stop reusing freed space while it is held.
+const viewSuffix = "-view"
+
+// ReadTx is a read-only transaction started by View. All its reads see the
+// index committed when View started.
+//
+// A ReadTx must only be used by the goroutine running the callback.
+type ReadTx struct {
+	e      *Bucket
+	idx    *index
+	closed bool
+}
+
+// View runs fn in a read-only transaction on a snapshot of the bucket: every
+// read made through tx sees the items committed when View started, whatever is
+// committed meanwhile, so paging with ListNext neither repeats nor skips items.
+//
+// Writers are not blocked while fn runs. While any view is open on the file,
+// in this process or another one, writers only append to the file: blocks
+// freed by their commits are not reused, and Compact reclaims nothing, until
+// the last view ends.
+func (e *Bucket) View(fn func(tx *ReadTx) error) error {
+	return e.ViewCtx(context.Background(), fn)
+}
+
+// ViewCtx is like View but gives up waiting for the file lock when ctx is
+// done, returning ErrLockTimeout.
+func (e *Bucket) ViewCtx(ctx context.Context, fn func(tx *ReadTx) error) error {
+	// Take the view lock before loading the index: a writer that commits
+	// after this point sees the view.
+	if err := e.beginView(); err != nil {
+		return err
+	}
+	defer e.endView()
+	var idx *index
+	err := e.view(ctx, func(i *index) error {
+		idx = i
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tx := &ReadTx{e: e, idx: idx}
+	defer func() { tx.closed = true }()
+	return fn(tx)
+}
+
+// beginView registers an open view. The views of a Bucket share one shared
+// lock on the view file: the first view takes it and the last one releases it.
+// An Exclusive Bucket is the only user of the file and just counts its views.
+func (e *Bucket) beginView() error {
+	e.viewMu.Lock()
+	defer e.viewMu.Unlock()
+	if e.views == 0 && !e.exclusive {
+		f, err := os.OpenFile(e.path+viewSuffix, os.O_CREATE|os.O_RDONLY, e.perm)
+		if err != nil {
+			if e.readOnly {
+				// No writer can create the view file either, e.g. on a
+				// read-only mount.
+				e.views++
+				return nil
+			}
+			return err
+		}
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+			_ = f.Close()
+			return err
+		}
+		e.viewFile = f
+	}
+	e.views++
+	return nil
+}
+
+func (e *Bucket) endView() {
+	e.viewMu.Lock()
+	defer e.viewMu.Unlock()
+	e.views--
+	if e.views == 0 && e.viewFile != nil {
+		_ = e.viewFile.Close()
+		e.viewFile = nil
+	}
+}
+
+// viewsActive reports whether a view is open on the file, in this process or
+// another one. It must be called with the exclusive file lock held, so that a
+// view starting later loads the index of the commit in progress.
+func (e *Bucket) viewsActive() bool {
+	if e.exclusive {
+		e.viewMu.Lock()
+		defer e.viewMu.Unlock()
+		return e.views > 0
+	}
+	f, err := os.Open(e.path + viewSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	// flock locks of different open files conflict even within a process, so
+	// this also sees the views of e.
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil
+}
+
+// readSnapshot runs fn under the shared file lock, so that no other process
+// writes while fn reads blocks of the snapshot.
+func (tx *ReadTx) readSnapshot(fn func() error) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	return tx.e.read(context.Background(), fn)
+}
+
+// Get returns the value stored for key in the snapshot, or ErrNotFound.
+func (tx *ReadTx) Get(key []byte) (data []byte, err error) {
+	err = tx.readSnapshot(func() error {
+		var item Item
+		item, err = tx.e.getOneData(tx.idx, key)
+		data = item.Data
+		return err
+	})
+	return data, err
+}
+
+// List returns up to limit items from the beginning of the snapshot.
+func (tx *ReadTx) List(limit uint8) ([]Item, error) {
+	return tx.ListNext(limit, 0)
+}
+
+// ListNext returns up to limit items of the snapshot after skipping skip items.
+func (tx *ReadTx) ListNext(limit uint8, skip uint) (result []Item, err error) {
+	err = tx.readSnapshot(func() error {
+		result, err = tx.e.getListNextData(tx.idx, limit, skip)
+		return err
+	})
+	return result, err
+}
+
+// FindNext returns up to limit items of the snapshot starting from key, like
+// Bucket.FindNext.
+func (tx *ReadTx) FindNext(key []byte, limit uint8, onlyAfterKey bool) (result []Item, err error) {
+	err = tx.readSnapshot(func() error {
+		result, err = tx.e.getFindNextData(tx.idx, key, limit, onlyAfterKey)
+		return err
+	})
+	return result, err
+}
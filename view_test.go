@@ -0,0 +1,143 @@
+package blockbucketgo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+func TestViewSnapshot(t *testing.T) {
+	_, b := newTempBucket(t)
+
+	var items []blockbucketgo.Item
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		items = append(items, blockbucketgo.Item{Key: []byte(key), Data: []byte("v:" + key)})
+	}
+	b.SetMany(items)
+
+	var seen []blockbucketgo.Item
+	err := b.View(func(tx *blockbucketgo.ReadTx) error {
+		for page := uint(0); ; page++ {
+			batch, err := tx.ListNext(10, page*10)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+			seen = append(seen, batch...)
+
+			// Writers keep going between pages: consume, replace and add items,
+			// reusing the space they free as much as possible.
+			if _, err = b.ListLockDeleteE(5); err != nil {
+				return err
+			}
+			key := fmt.Sprintf("key-%02d", 29-page)
+			if _, err = b.Set(blockbucketgo.Item{Key: []byte(key), Data: []byte("changed")}); err != nil {
+				return err
+			}
+			if _, err = b.Set(blockbucketgo.Item{Key: []byte(fmt.Sprintf("new-%d", page)), Data: []byte("v:new")}); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("View error: %v", err)
+	}
+	if len(seen) != len(items) {
+		t.Fatalf("View saw %d items, want %d", len(seen), len(items))
+	}
+	for i := range items {
+		if string(seen[i].Key) != string(items[i].Key) ||
+			string(seen[i].Data) != string(items[i].Data) {
+			t.Fatalf(
+				"item %d in View: got %q=%q, want %q=%q",
+				i,
+				seen[i].Key,
+				seen[i].Data,
+				items[i].Key,
+				items[i].Data,
+			)
+		}
+	}
+
+	// The writes made during the view are visible afterwards.
+	if v, err := b.GetE([]byte("key-29")); err != nil || string(v) != "changed" {
+		t.Fatalf("GetE after View: got (%q, %v)", v, err)
+	}
+
+	var closed *blockbucketgo.ReadTx
+	_ = b.View(func(tx *blockbucketgo.ReadTx) error {
+		closed = tx
+		return nil
+	})
+	if _, err = closed.Get([]byte("key-29")); !errors.Is(err, blockbucketgo.ErrTxClosed) {
+		t.Fatalf("Get after View: got %v, want ErrTxClosed", err)
+	}
+}
+
+func TestViewSnapshotAcrossBuckets(t *testing.T) {
+	path, b := newTempBucket(t)
+	other, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	var items []blockbucketgo.Item
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		items = append(items, blockbucketgo.Item{Key: []byte(key), Data: []byte("v:" + key)})
+	}
+	b.SetMany(items)
+
+	var seen []blockbucketgo.Item
+	err = b.View(func(tx *blockbucketgo.ReadTx) error {
+		for page := uint(0); ; page++ {
+			batch, err := tx.ListNext(10, page*10)
+			if err != nil || len(batch) == 0 {
+				return err
+			}
+			seen = append(seen, batch...)
+
+			// Another Bucket on the file frees blocks and would reuse them.
+			if _, err = other.ListLockDeleteE(10); err != nil {
+				return err
+			}
+			if _, err = other.Set(blockbucketgo.Item{Key: []byte(fmt.Sprintf("new-%d", page)), Data: []byte("v:new-" + fmt.Sprint(page))}); err != nil {
+				return err
+			}
+			if _, err = other.Compact(context.Background()); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("View error: %v", err)
+	}
+	if len(seen) != len(items) {
+		t.Fatalf("View saw %d items, want %d", len(seen), len(items))
+	}
+	for i := range items {
+		if string(seen[i].Key) != string(items[i].Key) ||
+			string(seen[i].Data) != string(items[i].Data) {
+			t.Fatalf(
+				"item %d in View: got %q=%q, want %q=%q",
+				i,
+				seen[i].Key,
+				seen[i].Data,
+				items[i].Key,
+				items[i].Data,
+			)
+		}
+	}
+
+	// Once the view ended the space is reused again.
+	if n, err := other.Compact(context.Background()); err != nil || n == 0 {
+		t.Fatalf("Compact after View: got (%d, %v), want bytes reclaimed", n, err)
+	}
+}
@@ -0,0 +1,129 @@
+package blockbucketgo
+
+import (
+	"context"
+	"time"
+)
+
+// waitPollInterval is how often WaitAndConsume looks for items committed by
+// other processes when the data file cannot be watched.
+const waitPollInterval = time.Second
+
+// WaitAndConsume is like ListLockDelete but blocks until at least one item is
+// available, or ctx is done. It is woken by the commits of this Bucket, by
+// changes of the data file made by other processes (watched with inotify on
+// Linux, polled elsewhere), and when a delayed item or an expired lease
+// becomes consumable.
+//
+// When ctx is done while waiting it returns ctx.Err(); while waiting for the
+// file lock, ErrLockTimeout. When the Bucket is closed it returns ErrClosed.
+func (e *Bucket) WaitAndConsume(
+	ctx context.Context,
+	limit uint8,
+	opts ...WriteOption,
+) ([]Item, error) {
+	// Watch before looking, so that no commit is missed in between.
+	changes := make(chan struct{}, 1)
+	stop := watchFile(e.path, changes)
+	defer stop()
+	for {
+		notify := e.changed()
+		items, err := e.ListLockDeleteCtx(ctx, limit, opts...)
+		if err != nil || len(items) > 0 {
+			return items, err
+		}
+		if err = e.waitChange(ctx, notify, changes); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitChange blocks until notify is closed, changes receives, the next delayed
+// item or lease is due, or ctx is done.
+func (e *Bucket) waitChange(
+	ctx context.Context,
+	notify <-chan struct{},
+	changes <-chan struct{},
+) error {
+	due, err := e.nextDue()
+	if err != nil {
+		return err
+	}
+	var wake <-chan time.Time
+	if !due.IsZero() {
+		timer := time.NewTimer(time.Until(due))
+		defer timer.Stop()
+		wake = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-notify:
+	case <-changes:
+	case <-wake:
+	}
+	return nil
+}
+
+// changed returns a channel closed by the next commit of e.
+func (e *Bucket) changed() <-chan struct{} {
+	e.notifyMu.Lock()
+	defer e.notifyMu.Unlock()
+	if e.notify == nil {
+		e.notify = make(chan struct{})
+	}
+	return e.notify
+}
+
+// signal wakes the goroutines waiting on changed.
+func (e *Bucket) signal() {
+	e.notifyMu.Lock()
+	defer e.notifyMu.Unlock()
+	if e.notify != nil {
+		close(e.notify)
+		e.notify = nil
+	}
+}
+
+// nextDue returns the earliest time after now at which an item that is not
+// dead becomes consumable, or the zero time when none is delayed nor leased.
+func (e *Bucket) nextDue() (due time.Time, err error) {
+	now := uint64(time.Now().UnixNano())
+	err = e.view(context.Background(), func(idx *index) error {
+		var next uint64
+		for i := 0; i < len(idx.listBlock); i++ {
+			b := idx.listBlock[i]
+			if at := max(b.notBefore, b.leaseUntil); !b.dead && at > now {
+				if next == 0 || at < next {
+					next = at
+				}
+			}
+		}
+		if next > 0 {
+			due = time.Unix(0, int64(next))
+		}
+		return nil
+	})
+	return due, err
+}
+
+// pollFile sends to changes every waitPollInterval until stop is called.
+func pollFile(changes chan<- struct{}) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(waitPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
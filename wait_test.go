@@ -0,0 +1,79 @@
+package blockbucketgo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+func TestWaitAndConsume(t *testing.T) {
+	path, b := newTempBucket(t)
+	other, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if items, err := b.WaitAndConsume(ctx, 10); !errors.Is(err, context.DeadlineExceeded) ||
+		len(items) != 0 {
+		t.Fatalf(
+			"WaitAndConsume on an empty bucket: got (%q, %v) want DeadlineExceeded",
+			items,
+			err,
+		)
+	}
+
+	// Woken by a commit of the same Bucket, then by another one on the file.
+	for _, producer := range []*blockbucketgo.Bucket{b, other} {
+		time.AfterFunc(20*time.Millisecond, func() {
+			producer.Set(blockbucketgo.Item{Key: []byte("job"), Data: []byte("a")})
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		items, err := b.WaitAndConsume(ctx, 10)
+		cancel()
+		if err != nil || len(items) != 1 || string(items[0].Key) != "job" {
+			t.Fatalf("WaitAndConsume: got (%q, %v) want job", items, err)
+		}
+	}
+
+	// Woken when a delayed item is due.
+	at := time.Now().Add(30 * time.Millisecond)
+	b.SetDelayed(blockbucketgo.Item{Key: []byte("later"), Data: []byte("b")}, at)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	items, err := b.WaitAndConsume(ctx, 10)
+	if err != nil || len(items) != 1 || string(items[0].Key) != "later" || time.Now().Before(at) {
+		t.Fatalf("WaitAndConsume of a delayed item: got (%q, %v) want later", items, err)
+	}
+}
+
+func TestWaitAndConsumeClose(t *testing.T) {
+	_, b := newTempBucket(t)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.WaitAndConsume(context.Background(), 10)
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	b.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, blockbucketgo.ErrClosed) {
+			t.Fatalf("WaitAndConsume during Close: got %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitAndConsume still waiting after Close")
+	}
+	item := blockbucketgo.Item{Key: []byte("k")}
+	if _, err := b.Set(item); !errors.Is(err, blockbucketgo.ErrClosed) {
+		t.Fatalf("Set after Close: got %v, want ErrClosed", err)
+	}
+	if _, err := b.GetE([]byte("k")); !errors.Is(err, blockbucketgo.ErrClosed) {
+		t.Fatalf("GetE after Close: got %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,335 @@
+package blockbucketgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The write-ahead log is a sidecar file next to the data file (path + "-wal").
+// Every commit is appended to it as one record, and the log is synced before
+// the data file is touched:
+//
+//	size u32 | crc32 u32 | payload | size u32 | state u8
+//
+// The payload lists the positioned writes of the commit as uvarint
+// (offset, length) pairs, each followed by its bytes. The trailing state byte
+// is set to walApplied once the writes reached the data file, so a writer that
+// finds an unapplied last record knows that another process died mid-commit and
+// redoes it. Open replays the whole log and then checkpoints it: the data file
+// is synced and the log truncated.
+const (
+	walSuffix         = "-wal"
+	walCheckpointSize = 4 << 20
+	walHeaderSize     = 8
+	walTrailerSize    = 5
+	walPending        = byte(0)
+	walApplied        = byte(1)
+)
+
+// walWrite is one positioned write of a commit.
+type walWrite struct {
+	off  int64
+	data []byte
+}
+
+func encodeWalRecord(writes []walWrite) []byte {
+	var payload []byte
+	payload = binary.AppendUvarint(payload, uint64(len(writes)))
+	for i := 0; i < len(writes); i++ {
+		payload = binary.AppendUvarint(payload, uint64(writes[i].off))
+		payload = binary.AppendUvarint(payload, uint64(len(writes[i].data)))
+		payload = append(payload, writes[i].data...)
+	}
+	record := make([]byte, 0, walHeaderSize+len(payload)+walTrailerSize)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(payload)))
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(payload)))
+	return append(record, walPending)
+}
+
+func decodeWalPayload(payload []byte) ([]walWrite, error) {
+	count, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: bad write-ahead log record", ErrCorrupt)
+	}
+	payload = payload[n:]
+	writes := make([]walWrite, 0, count)
+	for i := uint64(0); i < count; i++ {
+		off, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad write-ahead log record", ErrCorrupt)
+		}
+		payload = payload[n:]
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < size {
+			return nil, fmt.Errorf("%w: bad write-ahead log record", ErrCorrupt)
+		}
+		payload = payload[n:]
+		writes = append(writes, walWrite{off: int64(off), data: payload[:size]})
+		payload = payload[size:]
+	}
+	return writes, nil
+}
+
+// readWalRecord reads the record starting at off. It reports ok == false when
+// the record is torn, i.e. its commit was never acknowledged.
+func (e *Bucket) readWalRecord(
+	off int64,
+	size int64,
+) (writes []walWrite, next int64, ok bool, err error) {
+	if size-off < walHeaderSize+walTrailerSize {
+		return nil, off, false, nil
+	}
+	head := make([]byte, walHeaderSize)
+	if _, err = e.wal.ReadAt(head, off); err != nil {
+		return nil, off, false, err
+	}
+	payloadSize := int64(binary.LittleEndian.Uint32(head))
+	next = off + walHeaderSize + payloadSize + walTrailerSize
+	if next > size {
+		return nil, off, false, nil
+	}
+	payload := make([]byte, payloadSize)
+	if _, err = e.wal.ReadAt(payload, off+walHeaderSize); err != nil {
+		return nil, off, false, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(head[4:]) {
+		return nil, off, false, nil
+	}
+	writes, err = decodeWalPayload(payload)
+	if err != nil {
+		return nil, off, false, nil
+	}
+	return writes, next, true, nil
+}
+
+// appendWal appends the commit to the log, syncing it for SyncCommit. It
+// returns the offset of the record state byte.
+func (e *Bucket) appendWal(writes []walWrite, mode SyncMode) (int64, error) {
+	if e.wal == nil {
+		wal, err := os.OpenFile(e.path+walSuffix, os.O_CREATE|os.O_RDWR, e.perm)
+		if err != nil {
+			return 0, err
+		}
+		e.wal = wal
+		// Syncing the log is not enough for a log that was just created:
+		// its directory entry must be durable too.
+		if err = syncDir(e.path); err != nil {
+			return 0, err
+		}
+	}
+	info, err := e.wal.Stat()
+	if err != nil {
+		return 0, err
+	}
+	record := encodeWalRecord(writes)
+	if _, err = e.wal.WriteAt(record, info.Size()); err != nil {
+		return 0, err
+	}
+	if mode == SyncCommit {
+		if err = e.wal.Sync(); err != nil {
+			return 0, err
+		}
+		e.walDirty = false
+	} else {
+		e.walDirty = true
+	}
+	return info.Size() + int64(len(record)) - 1, nil
+}
+
+// applyWrites writes a commit to the data file. Header writes go last, so a
+// partially applied commit never exposes a list that was not fully written.
+func (e *Bucket) applyWrites(writes []walWrite) error {
+	sort.SliceStable(writes, func(i, j int) bool {
+		return writes[i].off >= int64(cFirstSize) && writes[j].off < int64(cFirstSize)
+	})
+	for i := 0; i < len(writes); i++ {
+		if _, err := e.writer.WriteAt(writes[i].data, writes[i].off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit logs and applies the writes queued by the current mutation.
+func (e *Bucket) commit(mode SyncMode) error {
+	writes := e.pending
+	e.pending = nil
+	if len(writes) == 0 {
+		return nil
+	}
+	stateOff, err := e.appendWal(writes, mode)
+	if err != nil {
+		return err
+	}
+	if err = e.applyWrites(writes); err != nil {
+		return err
+	}
+	if _, err = e.wal.WriteAt([]byte{walApplied}, stateOff); err != nil {
+		return err
+	}
+	if stateOff >= walCheckpointSize {
+		return e.checkpoint()
+	}
+	return nil
+}
+
+// recoverWal redoes the last logged commit if its writer died before applying
+// it, and drops a torn record left by a writer that died while logging.
+// It must be called with the exclusive file lock held.
+func (e *Bucket) recoverWal() error {
+	if e.wal == nil {
+		// Another process may have created the log since Open.
+		if err := e.openWal(); err != nil || e.wal == nil {
+			return err
+		}
+	}
+	info, err := e.wal.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil
+	}
+	if size >= walHeaderSize+walTrailerSize {
+		trailer := make([]byte, walTrailerSize)
+		if _, err = e.wal.ReadAt(trailer, size-walTrailerSize); err != nil {
+			return err
+		}
+		if trailer[4] == walApplied {
+			return nil
+		}
+		start := size - walTrailerSize - int64(binary.LittleEndian.Uint32(trailer)) - walHeaderSize
+		if start >= 0 {
+			writes, next, ok, err := e.readWalRecord(start, size)
+			if err != nil {
+				return err
+			}
+			if ok && next == size {
+				return e.redoWal(writes, size-1)
+			}
+		}
+	}
+	// The tail is torn: find the last complete record and redo it.
+	var off, last int64
+	var lastWrites []walWrite
+	for {
+		writes, next, ok, err := e.readWalRecord(off, size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		lastWrites, last, off = writes, next, next
+	}
+	if err = e.wal.Truncate(off); err != nil {
+		return err
+	}
+	if lastWrites == nil {
+		return nil
+	}
+	return e.redoWal(lastWrites, last-1)
+}
+
+func (e *Bucket) redoWal(writes []walWrite, stateOff int64) error {
+	if err := e.applyWrites(writes); err != nil {
+		return err
+	}
+	_, err := e.wal.WriteAt([]byte{walApplied}, stateOff)
+	return err
+}
+
+// replayWal redoes every complete record of the log in order and checkpoints.
+// It must be called with the exclusive file lock held.
+func (e *Bucket) replayWal() error {
+	info, err := e.wal.Stat()
+	if err != nil {
+		return err
+	}
+	var off int64
+	for {
+		writes, next, ok, err := e.readWalRecord(off, info.Size())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err = e.applyWrites(writes); err != nil {
+			return err
+		}
+		off = next
+	}
+	return e.checkpoint()
+}
+
+// checkpoint makes the data file durable and empties the log.
+func (e *Bucket) checkpoint() error {
+	if e.wal == nil {
+		return nil
+	}
+	if err := e.writer.Sync(); err != nil {
+		return err
+	}
+	e.walDirty = false
+	return e.wal.Truncate(0)
+}
+
+// startSyncLoop syncs the log every d while there are unsynced commits.
+func (e *Bucket) startSyncLoop(d time.Duration) {
+	if d <= 0 {
+		d = time.Second
+	}
+	stop := make(chan struct{})
+	e.stopSync = stop
+	e.syncGroup.Add(1)
+	go func() {
+		defer e.syncGroup.Done()
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			e.mu.Lock()
+			if e.walDirty && e.wal != nil && e.wal.Sync() == nil {
+				e.walDirty = false
+			}
+			e.mu.Unlock()
+		}
+	}()
+}
+
+// syncDir makes the directory entries of the files next to path durable.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// openWal opens an existing log. A missing log is created by the first commit.
+func (e *Bucket) openWal() error {
+	wal, err := os.OpenFile(e.path+walSuffix, os.O_RDWR, e.perm)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.wal = wal
+	return nil
+}
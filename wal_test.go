@@ -0,0 +1,170 @@
+package blockbucketgo_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/manhavn/blockbucketgo"
+)
+
+// tearHeader overwrites the header region of the data file, as a crash in the
+// middle of a header write would.
+func tearHeader(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteAt(make([]byte, 128), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalReplayOnOpen(t *testing.T) {
+	path, b := newTempBucket(t)
+
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := b.Set(blockbucketgo.Item{Key: []byte(k), Data: []byte("v-" + k)}); err != nil {
+			t.Fatalf("Set error: %v", err)
+		}
+	}
+	tearHeader(t, path)
+
+	// Garbage after the last record is a commit that was never acknowledged.
+	wal, err := os.OpenFile(path+"-wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	_, _ = wal.Write([]byte{1, 2, 3})
+	_ = wal.Close()
+
+	b2, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("Open after crash: %v", err)
+	}
+	defer b2.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if v, err := b2.GetE([]byte(k)); err != nil || string(v) != "v-"+k {
+			t.Fatalf("GetE(%q) after replay: got (%q, %v)", k, v, err)
+		}
+	}
+	if info, err := os.Stat(path + "-wal"); err != nil || info.Size() != 0 {
+		t.Fatalf("wal not checkpointed after Open: %v, %v", info, err)
+	}
+}
+
+func TestWalRedoUnappliedCommit(t *testing.T) {
+	path, b := newTempBucket(t)
+
+	b2, err := blockbucketgo.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b2.Close()
+
+	if _, err = b.Set(blockbucketgo.Item{Key: []byte("a"), Data: []byte("1")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+
+	// Pretend the writer died after logging the commit but before applying it.
+	wal, err := os.OpenFile(path+"-wal", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	info, _ := wal.Stat()
+	_, _ = wal.WriteAt([]byte{0}, info.Size()-1)
+	_ = wal.Close()
+	tearHeader(t, path)
+
+	if _, err = b2.Set(blockbucketgo.Item{Key: []byte("b"), Data: []byte("2")}); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		if v, err := b2.GetE([]byte(k)); err != nil || string(v) != want {
+			t.Fatalf("GetE(%q): got (%q, %v) want %q", k, v, err, want)
+		}
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	for name, opt := range map[string]blockbucketgo.Option{
+		"commit":   blockbucketgo.Sync(blockbucketgo.SyncCommit),
+		"none":     blockbucketgo.Sync(blockbucketgo.SyncNone),
+		"interval": blockbucketgo.SyncEvery(5 * time.Millisecond),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data.db")
+			b, err := blockbucketgo.Open(path, opt)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if _, err = b.Set(blockbucketgo.Item{Key: []byte("a"), Data: []byte("1")}); err != nil {
+				t.Fatalf("Set error: %v", err)
+			}
+			_, err = b.Set(
+				blockbucketgo.Item{Key: []byte("b"), Data: []byte("2")},
+				blockbucketgo.WriteSync(blockbucketgo.SyncCommit),
+			)
+			if err != nil {
+				t.Fatalf("Set with WriteSync: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			b.Close()
+
+			b, err = blockbucketgo.Open(path)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer b.Close()
+			if items, err := b.ListE(10); err != nil || len(items) != 2 {
+				t.Fatalf("ListE after reopen: got (%d items, %v) want 2", len(items), err)
+			}
+		})
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	b, err := blockbucketgo.Open(
+		filepath.Join(t.TempDir(), "data.db"),
+		blockbucketgo.SyncEvery(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Set(blockbucketgo.Item{Key: []byte("a"), Data: []byte("1")})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Go(b.Close)
+	}
+	wg.Wait()
+}
+
+func BenchmarkSetSyncMode(b *testing.B) {
+	for name, mode := range map[string]blockbucketgo.SyncMode{
+		"commit": blockbucketgo.SyncCommit,
+		"none":   blockbucketgo.SyncNone,
+	} {
+		b.Run(name, func(b *testing.B) {
+			bucket, err := blockbucketgo.Open(
+				filepath.Join(b.TempDir(), "data.db"),
+				blockbucketgo.Sync(mode),
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer bucket.Close()
+			value := []byte("benchmark value")
+			for i := 0; b.Loop(); i++ {
+				key := []byte("key-" + strconv.Itoa(i%100))
+				if _, err = bucket.Set(blockbucketgo.Item{Key: key, Data: value}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}